@@ -0,0 +1,193 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/logrusorgru/aurora/v4"
+)
+
+// archiveMaxBytes limits archives submitted through stdin, compressed
+// and extracted, and packs pushed by git, unless ArchiveMaxBytes is set.
+const archiveMaxBytes = 64 << 20
+
+var errArchiveTooLarge = errors.New("archive too large")
+
+// ArchiveLimit returns the configured limit, see archiveMaxBytes.
+func ArchiveLimit() int64 {
+	if cfg.ArchiveMaxBytes > 0 {
+		return cfg.ArchiveMaxBytes
+	}
+	return archiveMaxBytes
+}
+
+// StageArchive extracts a tar, tar.gz or zip archive read from r into dir,
+// keeping only the files named in pb.Submits. It fails if a submit is
+// missing or an entry tries to leave dir.
+func StageArchive(r io.Reader, dir string, pb *Problem, uf Userface) error {
+	limit := ArchiveLimit()
+
+	lr := &io.LimitedReader{R: r, N: limit + 1}
+	br := bufio.NewReader(lr)
+	magic, _ := br.Peek(4)
+
+	if err := mkdirOwned(dir); err != nil {
+		return err
+	}
+	st := &archiveStager{dir: dir, pb: pb, uf: uf, left: limit, seen: map[string]bool{}}
+
+	var err error
+	switch {
+	case bytes.HasPrefix(magic, []byte("PK\x03\x04")), bytes.HasPrefix(magic, []byte("PK\x05\x06")):
+		err = st.zip(br)
+	case bytes.HasPrefix(magic, []byte("\x1f\x8b")):
+		var gz *gzip.Reader
+		gz, err = gzip.NewReader(br)
+		if err == nil {
+			err = st.tar(gz)
+		}
+	default:
+		err = st.tar(br)
+	}
+	if lr.N <= 0 {
+		return errArchiveTooLarge
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, submit := range pb.Submits {
+		if !st.seen[path.Clean(submit.Path)] {
+			return fmt.Errorf("%s is missing in the archive", submit.Path)
+		}
+	}
+	return nil
+}
+
+type archiveStager struct {
+	dir  string
+	pb   *Problem
+	uf   Userface
+	left int64 // bytes that may still be extracted
+	seen map[string]bool
+}
+
+// submitOf returns the submit path that name belongs to, if any.
+func (st *archiveStager) submitOf(name string) (string, bool) {
+	for _, submit := range st.pb.Submits {
+		p := path.Clean(submit.Path)
+		if name == p || (submit.IsDir && strings.HasPrefix(name, p+"/")) {
+			return p, true
+		}
+	}
+	return "", false
+}
+
+// add writes the regular file name of the archive to dir.
+func (st *archiveStager) add(name string, mode fs.FileMode, r io.Reader) error {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == "" {
+		return nil
+	}
+	if !fs.ValidPath(name) {
+		return fmt.Errorf("invalid path %s", strconv.Quote(name))
+	}
+
+	submit, ok := st.submitOf(name)
+	if !ok {
+		st.uf.Println("	*", aurora.Gray(15, name), ":", aurora.Gray(15, "ignored"))
+		return nil
+	}
+	if !mode.IsRegular() {
+		st.uf.Println("	*", aurora.Yellow(name), ":", aurora.Gray(15, "not a regular file, ignored"))
+		return nil
+	}
+	st.seen[submit] = true
+
+	dst := path.Join(st.dir, name)
+	if err := mkdirOwned(path.Dir(dst)); err != nil {
+		return err
+	}
+	perm := os.FileMode(0600)
+	if mode&0100 != 0 {
+		perm = 0700
+	}
+	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	f.Chown(cfg.SubmitUid, cfg.SubmitGid)
+
+	n, err := io.Copy(f, io.LimitReader(r, st.left+1))
+	st.left -= n
+	if err != nil {
+		return err
+	}
+	if st.left < 0 {
+		return errArchiveTooLarge
+	}
+	return nil
+}
+
+func (st *archiveStager) tar(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("not a tar or zip archive: %v", err)
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			continue
+		}
+		mode := hdr.FileInfo().Mode()
+		if hdr.Typeflag == tar.TypeLink {
+			// FileInfo takes hardlinks for empty regular files
+			mode |= fs.ModeIrregular
+		}
+		if err := st.add(hdr.Name, mode, tr); err != nil {
+			return err
+		}
+	}
+}
+
+func (st *archiveStager) zip(r io.Reader) error {
+	// zip keeps its index at the end
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return fmt.Errorf("not a zip archive: %v", err)
+	}
+	for _, zf := range zr.File {
+		if zf.FileInfo().IsDir() {
+			continue
+		}
+		rc, err := zf.Open()
+		if err != nil {
+			return err
+		}
+		err = st.add(zf.Name, zf.Mode(), rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
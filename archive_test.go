@@ -0,0 +1,203 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+type archiveEntry struct {
+	name     string
+	body     string
+	typeflag byte   // tar.TypeReg if zero
+	link     string // of symlinks and hardlinks
+}
+
+func tarArchive(t *testing.T, entries []archiveEntry, compress bool) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var tw *tar.Writer
+	var gz *gzip.Writer
+	if compress {
+		gz = gzip.NewWriter(&buf)
+		tw = tar.NewWriter(gz)
+	} else {
+		tw = tar.NewWriter(&buf)
+	}
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Typeflag: e.typeflag, Linkname: e.link, Mode: 0644, Size: int64(len(e.body))}
+		if hdr.Typeflag == 0 {
+			hdr.Typeflag = tar.TypeReg
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			hdr.Size = 0
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			tw.Write([]byte(e.body))
+		}
+	}
+	tw.Close()
+	if gz != nil {
+		gz.Close()
+	}
+	return buf.Bytes()
+}
+
+func zipArchive(t *testing.T, entries []archiveEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range entries {
+		w, err := zw.Create(e.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(e.body))
+	}
+	zw.Close()
+	return buf.Bytes()
+}
+
+func TestStageArchive(t *testing.T) {
+	pb := &Problem{Id: "p", Submits: []Submit{{Path: "main.c"}, {Path: "src", IsDir: true}}}
+	valid := []archiveEntry{{name: "main.c", body: "int main(){}"}, {name: "src/a.c", body: "a"}}
+
+	tests := []struct {
+		name    string
+		archive func(t *testing.T) []byte
+		err     string // empty for success
+		files   map[string]string
+	}{
+		{
+			name:    "tar",
+			archive: func(t *testing.T) []byte { return tarArchive(t, valid, false) },
+			files:   map[string]string{"main.c": "int main(){}", "src/a.c": "a"},
+		},
+		{
+			name:    "tar.gz",
+			archive: func(t *testing.T) []byte { return tarArchive(t, valid, true) },
+			files:   map[string]string{"main.c": "int main(){}", "src/a.c": "a"},
+		},
+		{
+			name:    "zip",
+			archive: func(t *testing.T) []byte { return zipArchive(t, valid) },
+			files:   map[string]string{"main.c": "int main(){}", "src/a.c": "a"},
+		},
+		{
+			name: "dot dot stays inside",
+			archive: func(t *testing.T) []byte {
+				return tarArchive(t, append([]archiveEntry{{name: "../../main.c", body: "escaped"}}, valid[1]), false)
+			},
+			files: map[string]string{"main.c": "escaped", "src/a.c": "a"},
+		},
+		{
+			name: "absolute stays inside",
+			archive: func(t *testing.T) []byte {
+				return zipArchive(t, []archiveEntry{{name: "/main.c", body: "abs"}, {name: "/src/a.c", body: "a"}})
+			},
+			files: map[string]string{"main.c": "abs", "src/a.c": "a"},
+		},
+		{
+			name: "unlisted files ignored",
+			archive: func(t *testing.T) []byte {
+				return tarArchive(t, append([]archiveEntry{{name: "notes.txt", body: "x"}}, valid...), false)
+			},
+			files: map[string]string{"main.c": "int main(){}", "notes.txt": ""},
+		},
+		{
+			name: "symlink ignored",
+			archive: func(t *testing.T) []byte {
+				return tarArchive(t, []archiveEntry{{name: "main.c", typeflag: tar.TypeSymlink, link: "/etc/passwd"}, valid[1]}, false)
+			},
+			err: "main.c is missing",
+		},
+		{
+			name: "hardlink ignored",
+			archive: func(t *testing.T) []byte {
+				return tarArchive(t, []archiveEntry{valid[0], {name: "src/a.c", typeflag: tar.TypeLink, link: "main.c"}}, false)
+			},
+			err: "src is missing",
+		},
+		{
+			name:    "missing submit",
+			archive: func(t *testing.T) []byte { return tarArchive(t, valid[:1], true) },
+			err:     "src is missing",
+		},
+		{
+			name: "oversized archive",
+			archive: func(t *testing.T) []byte {
+				return tarArchive(t, []archiveEntry{{name: "main.c", body: strings.Repeat("x", 10000)}, valid[1]}, false)
+			},
+			err: errArchiveTooLarge.Error(),
+		},
+		{
+			// small compressed, too large extracted
+			name: "oversized entry",
+			archive: func(t *testing.T) []byte {
+				return tarArchive(t, []archiveEntry{{name: "main.c", body: strings.Repeat("x", 100000)}, valid[1]}, true)
+			},
+			err: errArchiveTooLarge.Error(),
+		},
+		{
+			name: "oversized zip",
+			archive: func(t *testing.T) []byte {
+				return zipArchive(t, []archiveEntry{valid[0], {name: "src/a.c", body: strings.Repeat("x", 100000)}})
+			},
+			err: errArchiveTooLarge.Error(),
+		},
+		{
+			name:    "not an archive",
+			archive: func(t *testing.T) []byte { return []byte("int main(){}\n") },
+			err:     "not a tar or zip archive",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestEnv(t)
+			cfg.ArchiveMaxBytes = 8192
+
+			parent := t.TempDir()
+			dir := path.Join(parent, "stage")
+			err := StageArchive(bytes.NewReader(tt.archive(t)), dir, pb, Userface{Buffer: &bytes.Buffer{}, Writer: &bytes.Buffer{}})
+			switch {
+			case tt.err == "" && err != nil:
+				t.Fatal(err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Fatalf("got error %v, want %q", err, tt.err)
+			}
+			if tt.err == errArchiveTooLarge.Error() && !errors.Is(err, errArchiveTooLarge) {
+				t.Errorf("got %v, want errArchiveTooLarge", err)
+			}
+
+			for name, body := range tt.files {
+				got, err := os.ReadFile(path.Join(dir, name))
+				switch {
+				case body == "" && err == nil:
+					t.Errorf("%s extracted", name)
+				case body != "" && string(got) != body:
+					t.Errorf("%s is %q, want %q (%v)", name, got, body, err)
+				}
+			}
+
+			// nothing may be written next to dir
+			entries, _ := os.ReadDir(parent)
+			if len(entries) > 1 {
+				t.Errorf("archive wrote outside of dir: %v", entries)
+			}
+			if tt.name == "symlink ignored" {
+				if _, err := os.Lstat(path.Join(dir, "main.c")); err == nil {
+					t.Error("symlink extracted")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// attachmentsTarget is where workflows find the attachments of their problem.
+const attachmentsTarget = "/attachments"
+
+// AttachmentFile is a regular file in the attachments of a problem.
+type AttachmentFile struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// ListAttachments returns the regular files in the attachments of pb, by
+// path. Symlinks are left out.
+func ListAttachments(pb Problem) ([]AttachmentFile, error) {
+	if pb.Attachments == "" {
+		return nil, nil
+	}
+
+	var files []AttachmentFile
+	err := filepath.WalkDir(pb.Attachments, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(pb.Attachments, p)
+		files = append(files, AttachmentFile{Path: filepath.ToSlash(rel), Size: info.Size()})
+		return nil
+	})
+	return files, err
+}
+
+// AttachmentPath maps name, a slash separated path in the attachments of
+// pb, to the host. Symlinks are only followed while they stay inside.
+func AttachmentPath(pb Problem, name string) (string, error) {
+	if pb.Attachments == "" {
+		return "", os.ErrNotExist
+	}
+	root, err := filepath.EvalSymlinks(pb.Attachments)
+	if err != nil {
+		return "", err
+	}
+
+	full := filepath.Join(root, path.Clean("/"+name))
+	real, err := filepath.EvalSymlinks(full)
+	if err != nil {
+		return "", err
+	}
+	if real != root && !strings.HasPrefix(real, root+"/") {
+		return "", os.ErrPermission
+	}
+	return full, nil
+}
+
+// attachmentInfo shows a file of the attachments read-only, under the name
+// it has in the SFTP view.
+type attachmentInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (fi attachmentInfo) Name() string {
+	return fi.name
+}
+
+func (fi attachmentInfo) Mode() os.FileMode {
+	return fi.FileInfo.Mode() &^ 0222
+}
+
+// problemsDirInfo is the /problems directory of the SFTP view.
+type problemsDirInfo struct{}
+
+func (problemsDirInfo) Name() string       { return "problems" }
+func (problemsDirInfo) Size() int64        { return 0 }
+func (problemsDirInfo) Mode() os.FileMode  { return os.ModeDir | 0555 }
+func (problemsDirInfo) ModTime() time.Time { return time.Time{} }
+func (problemsDirInfo) IsDir() bool        { return true }
+func (problemsDirInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+// RunCLI runs an offline maintenance command and returns the exit code.
+func RunCLI(args []string) int {
+	switch args[0] {
+	case "migrate":
+		if len(args) > 2 {
+			fmt.Fprintln(os.Stderr, "usage: soj migrate [status|<version>]")
+			return 2
+		}
+
+		var err error
+		db, err = OpenDB(cfg.DBDriver, cfg.DSN())
+		if err != nil {
+			log.Error().Err(err).Str("driver", cfg.DBDriver).Msg("failed to open database")
+			return 1
+		}
+		InitLogStore()
+
+		cur, err := CurrentSchemaVersion()
+		if err != nil {
+			log.Error().Err(err).Msg("failed to read schema version")
+			return 1
+		}
+
+		target := LatestSchemaVersion()
+		if len(args) == 2 {
+			if args[1] == "status" {
+				fmt.Println("schema version", cur, "of", LatestSchemaVersion())
+				for _, mg := range migrations {
+					state := "pending"
+					if mg.Version <= cur {
+						state = "applied"
+					}
+					fmt.Printf("  %3d %-8s %s\n", mg.Version, state, mg.Name)
+				}
+				return 0
+			}
+			target, err = strconv.Atoi(args[1])
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "invalid version", strconv.Quote(args[1]))
+				return 2
+			}
+		}
+
+		err = MigrateTo(target)
+		if err != nil {
+			log.Error().Err(err).Int("from", cur).Int("to", target).Msg("migration failed")
+			return 1
+		}
+		fmt.Println("schema version", cur, "->", target)
+		return 0
+
+	case "db":
+		if len(args) != 3 || (args[1] != "export" && args[1] != "import") {
+			fmt.Fprintln(os.Stderr, "usage: soj db export|import <file>")
+			return 2
+		}
+
+		var err error
+		db, err = OpenDB(cfg.DBDriver, cfg.DSN())
+		if err != nil {
+			log.Error().Err(err).Str("driver", cfg.DBDriver).Msg("failed to open database")
+			return 1
+		}
+		InitLogStore()
+
+		if args[1] == "export" {
+			err = ExportDB(args[2])
+		} else {
+			err = ImportDB(args[2])
+		}
+		if err != nil {
+			log.Error().Err(err).Str("file", args[2]).Msg("db " + args[1] + " failed")
+			return 1
+		}
+		return 0
+
+	case "lint":
+		if len(args) > 2 {
+			fmt.Fprintln(os.Stderr, "usage: soj lint [<dir>]")
+			return 2
+		}
+		dir := cfg.ProblemsDir
+		if len(args) == 2 {
+			dir = args[1]
+		}
+
+		problems, errs := LoadProblemDir(dir)
+		for _, e := range errs {
+			fmt.Println(e)
+		}
+		if errs != nil {
+			fmt.Println(len(errs), "errors in", dir)
+			return 1
+		}
+		fmt.Println(len(problems), "problems OK in", dir)
+		return 0
+
+	default:
+		fmt.Fprintln(os.Stderr, "unknown command", args[0])
+		fmt.Fprintln(os.Stderr, "usage: soj [migrate [status|<version>] | db export|import <file> | lint [<dir>]]")
+		return 2
+	}
+}
+
+// dumpRecord is one line of a database dump.
+type dumpRecord struct {
+	Submit *SubmitCtx `json:",omitempty"`
+	User   *User      `json:",omitempty"`
+	Log    *JudgeLog  `json:",omitempty"`
+	Quota  *Quota     `json:",omitempty"`
+}
+
+// ExportDB writes every submission and user of the current database to file
+// as JSON lines. The dump is driver independent and can be loaded with ImportDB.
+func ExportDB(file string) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+
+	var nsubmits, nusers, nlogs, nquotas int
+
+	var submits []SubmitCtx
+	tx := db.Order("submit_time").FindInBatches(&submits, 100, func(tx *gorm.DB, batch int) error {
+		for i := range submits {
+			if err := enc.Encode(dumpRecord{Submit: &submits[i]}); err != nil {
+				return err
+			}
+		}
+		nsubmits += len(submits)
+		return nil
+	})
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	var users []User
+	tx = db.Order("id").FindInBatches(&users, 100, func(tx *gorm.DB, batch int) error {
+		for i := range users {
+			if err := enc.Encode(dumpRecord{User: &users[i]}); err != nil {
+				return err
+			}
+		}
+		nusers += len(users)
+		return nil
+	})
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	var quotas []Quota
+	tx = db.Find(&quotas)
+	if tx.Error != nil {
+		return tx.Error
+	}
+	for i := range quotas {
+		if err := enc.Encode(dumpRecord{Quota: &quotas[i]}); err != nil {
+			return err
+		}
+	}
+	nquotas = len(quotas)
+
+	// logs in the file log store are not part of the database and must be copied separately
+	if db.Migrator().HasTable(&JudgeLog{}) {
+		var logs []JudgeLog
+		tx = db.Order("id").FindInBatches(&logs, 100, func(tx *gorm.DB, batch int) error {
+			for i := range logs {
+				if err := enc.Encode(dumpRecord{Log: &logs[i]}); err != nil {
+					return err
+				}
+			}
+			nlogs += len(logs)
+			return nil
+		})
+		if tx.Error != nil {
+			return tx.Error
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Println("exported", nsubmits, "submissions,", nusers, "users,", nquotas, "quotas and", nlogs, "logs to", file)
+	return nil
+}
+
+// ImportDB loads a dump written by ExportDB into the current database.
+// Existing rows with the same primary key are overwritten.
+func ImportDB(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := MigrateTo(LatestSchemaVersion()); err != nil {
+		return err
+	}
+
+	var nsubmits, nusers, nlogs, nquotas int
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		sc := bufio.NewScanner(f)
+		sc.Buffer(nil, 256*1024*1024)
+		for sc.Scan() {
+			var rec dumpRecord
+			if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+				return err
+			}
+			switch {
+			case rec.Submit != nil:
+				if err := tx.Save(rec.Submit).Error; err != nil {
+					return err
+				}
+				nsubmits++
+			case rec.User != nil:
+				if err := tx.Save(rec.User).Error; err != nil {
+					return err
+				}
+				nusers++
+			case rec.Log != nil:
+				if err := tx.Save(rec.Log).Error; err != nil {
+					return err
+				}
+				nlogs++
+			case rec.Quota != nil:
+				if err := tx.Save(rec.Quota).Error; err != nil {
+					return err
+				}
+				nquotas++
+			}
+		}
+		return sc.Err()
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("imported", nsubmits, "submissions,", nusers, "users,", nquotas, "quotas and", nlogs, "logs from", file)
+	return nil
+}
@@ -6,27 +6,36 @@ import (
 	"encoding/json"
 	"errors"
 
+	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 var db *gorm.DB
 
-type SubmitRecord struct {
-	ID      string `gorm:"primaryKey"`
-	User    string
-	Problem string
-
-	SubmitTime int64
-	LastUpdate int64
-
-	Status string
-	Msg    string
-
-	WorkflowStep string
-
-	SubmitsHash string
+// OpenDB opens a database with the given driver name and DSN.
+// An empty driver name selects sqlite.
+func OpenDB(driver string, dsn string) (*gorm.DB, error) {
+	var dialector gorm.Dialector
+	switch driver {
+	case "", "sqlite":
+		dialector = sqlite.Open(dsn)
+	case "postgres":
+		dialector = postgres.Open(dsn)
+	case "mysql":
+		dialector = mysql.Open(dsn)
+	default:
+		return nil, errors.New("unknown database driver " + driver)
+	}
+	return gorm.Open(dialector, &gorm.Config{})
+}
 
-	WorkflowLogs []string
+// ofUser matches the rows of user, also when user is empty, unlike a
+// SubmitCtx condition. The column is quoted, user is reserved in postgres.
+func ofUser(user string) clause.Eq {
+	return clause.Eq{Column: clause.Column{Name: "user"}, Value: user}
 }
 
 // Value 实现了 driver.Valuer 接口，使得 SubmitHash 可以被自动序列化为 JSON 字符串
@@ -112,10 +121,29 @@ func (sh Userface) Value() (driver.Value, error) {
 
 // Scan 实现了 sql.Scanner 接口，使得 JSON 字符串可以被自动反序列化为 SubmitHash
 func (sh *Userface) Scan(value interface{}) error {
-	b, ok := value.(string)
-	if !ok {
+	switch b := value.(type) {
+	case string:
+		sh.Buffer = bytes.NewBufferString(b)
+	case []byte: // mysql
+		sh.Buffer = bytes.NewBuffer(append([]byte(nil), b...))
+	default:
 		return errors.New("type assertion to string failed")
 	}
-	sh.Buffer = bytes.NewBufferString(b)
+	return nil
+}
+
+func (sh Userface) MarshalJSON() ([]byte, error) {
+	if sh.Buffer == nil {
+		return json.Marshal("")
+	}
+	return json.Marshal(sh.Buffer.String())
+}
+
+func (sh *Userface) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	sh.Buffer = bytes.NewBufferString(s)
 	return nil
 }
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+func TestOfUser(t *testing.T) {
+	setupTestEnv(t)
+
+	for i, user := range []string{"alice", "bob", "alice"} {
+		db.Create(&SubmitCtx{ID: string(rune('1' + i)), User: user, Problem: "p", Status: "completed"})
+	}
+
+	var n int64
+	db.Model(&SubmitCtx{}).Where(ofUser("alice")).Count(&n)
+	if n != 2 {
+		t.Errorf("alice has %d submissions, want 2", n)
+	}
+	// an empty ssh user name must not list everyone
+	db.Model(&SubmitCtx{}).Where(ofUser("")).Count(&n)
+	if n != 0 {
+		t.Errorf("empty user has %d submissions, want 0", n)
+	}
+
+	pg, err := gorm.Open(postgres.New(postgres.Config{DSN: "host=localhost"}), &gorm.Config{DryRun: true, DisableAutomaticPing: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sql := pg.ToSQL(func(tx *gorm.DB) *gorm.DB {
+		var submits []SubmitCtx
+		return tx.Where(ofUser("alice")).Find(&submits)
+	})
+	if !strings.Contains(sql, `"user" = 'alice'`) {
+		t.Errorf("user column not quoted for postgres: %s", sql)
+	}
+}
@@ -4,160 +4,306 @@ import (
 	"bytes"
 	"context"
 	"io"
-
+	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/docker/docker/api/types/container"
-	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/filters"
+	dimage "github.com/docker/docker/api/types/image"
+	dnetwork "github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/client"
 	"github.com/docker/docker/pkg/stdcopy"
-
 	"github.com/rs/zerolog/log"
 )
 
-var docker_cli *client.Client
+var maskedPaths = []string{"/etc", "/sys", "/proc/tty", "/proc/sys", "/proc/sysrq-trigger", "/proc/cmdline", "/proc/config.gz", "/proc/mounts", "/proc/fs", "/proc/device-tree", "/proc/bus"}
+
+// dockerRuntime runs containers on a Docker daemon, or on Podman through
+// its Docker compatible API.
+type dockerRuntime struct {
+	cli *client.Client
+
+	// podman does not honour AutoRemove and MaskedPaths on the compat API
+	podman bool
+	// rootless podman can not raise ulimits and maps container users
+	// through a user namespace, see RootlessRuntime
+	rootless bool
+}
+
+func NewDockerRuntime() (Runtime, error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv)
+	if err != nil {
+		return nil, err
+	}
+	return &dockerRuntime{cli: cli}, nil
+}
+
+// NewPodmanRuntime connects to the Podman API service at host, which
+// defaults to $CONTAINER_HOST or the socket of the current user.
+func NewPodmanRuntime(host string) (Runtime, error) {
+	rootless := os.Geteuid() != 0
 
-func RunImage(name string, user string, hostname string, image string, workdir string, mounts []mount.Mount, mask bool, ReadonlyRootfs bool, networkdisabled bool, timeout int, networkhosted bool, env []string) (ok bool, id string) {
+	if host == "" {
+		host = os.Getenv("CONTAINER_HOST")
+	}
+	if host == "" {
+		if rootless {
+			dir := os.Getenv("XDG_RUNTIME_DIR")
+			if dir == "" {
+				dir = "/run/user/" + strconv.Itoa(os.Geteuid())
+			}
+			host = "unix://" + dir + "/podman/podman.sock"
+		} else {
+			host = "unix:///run/podman/podman.sock"
+		}
+	}
+
+	cli, err := client.NewClientWithOpts(client.WithHost(host), client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, err
+	}
+	return &dockerRuntime{cli: cli, podman: true, rootless: rootless}, nil
+}
+
+// Rootless reports whether containers run in a user namespace owned by
+// the unprivileged user running SOJ.
+func (d *dockerRuntime) Rootless() bool {
+	return d.rootless
+}
 
+func (d *dockerRuntime) Create(ctx context.Context, spec ContainerSpec) (string, error) {
 	var masked []string
-	if mask {
-		masked = []string{"/etc", "/sys", "/proc/tty", "/proc/sys", "/proc/sysrq-trigger", "/proc/cmdline", "/proc/config.gz", "/proc/mounts", "/proc/fs", "/proc/device-tree", "/proc/bus"}
+	var secopts []string
+	if spec.MaskPaths {
+		if d.podman {
+			secopts = append(secopts, "mask="+strings.Join(maskedPaths, ":"))
+		} else {
+			masked = maskedPaths
+		}
+	}
+
+	var ulimits = []*container.Ulimit{
+		{Name: "memlock", Soft: -1, Hard: -1},
+	}
+	var userns = container.UsernsMode(spec.Userns)
+	if d.rootless {
+		// an unprivileged user can not go above its own hard limits
+		ulimits = nil
+		// keep the SOJ user as the owner of the bind mounted workdirs
+		if userns == "" {
+			userns = "keep-id"
+		}
 	}
+	secopts = append(secopts, spec.SecurityOpt...)
 
 	network := ""
-	if networkhosted {
+	var netcfg *dnetwork.NetworkingConfig
+	if spec.NetworkHost {
 		network = "host"
+	} else if spec.Network != "" {
+		network = spec.Network
+		netcfg = &dnetwork.NetworkingConfig{EndpointsConfig: map[string]*dnetwork.EndpointSettings{
+			spec.Network: {Aliases: spec.NetworkAliases},
+		}}
 	}
 
-	resp, err := docker_cli.ContainerCreate(context.Background(), &container.Config{
-		Image:           image,
-		User:            user,
-		Hostname:        hostname,
-		WorkingDir:      workdir,
-		NetworkDisabled: networkdisabled,
-		Env:             env,
+	var timeout = spec.StopTimeout
+
+	resp, err := d.cli.ContainerCreate(ctx, &container.Config{
+		Image:           spec.Image,
+		Cmd:             spec.Cmd,
+		User:            spec.User,
+		Hostname:        spec.Hostname,
+		WorkingDir:      spec.WorkDir,
+		NetworkDisabled: spec.NetworkDisabled,
+		Env:             spec.Env,
 		StopTimeout:     &timeout,
 	}, &container.HostConfig{
 		MaskedPaths:    masked,
-		Mounts:         mounts,
-		ReadonlyRootfs: ReadonlyRootfs,
-		AutoRemove:     true,
+		SecurityOpt:    secopts,
+		Mounts:         spec.Mounts,
+		Tmpfs:          spec.Tmpfs,
+		CapAdd:         spec.CapAdd,
+		CapDrop:        spec.CapDrop,
+		ReadonlyRootfs: spec.ReadonlyRootfs,
+		AutoRemove:     !d.podman,
 		NetworkMode:    container.NetworkMode(network),
+		UsernsMode:     userns,
 
-		Resources: container.Resources{Ulimits: []*container.Ulimit{
-			{Name: "memlock", Soft: -1, Hard: -1},
-		}},
-	}, nil, nil, name)
+		Resources: container.Resources{Ulimits: ulimits},
+	}, netcfg, nil, spec.Name)
 
 	if err != nil {
-		// log.Println(name, "container create error", err)
-		log.Err(err).Str("name", name).Str("image", image).Msg("container create error")
-		return false, ""
+		return "", err
 	}
+	return resp.ID, nil
+}
 
-	id = resp.ID
+func (d *dockerRuntime) Start(ctx context.Context, id string) error {
+	return d.cli.ContainerStart(ctx, id, container.StartOptions{})
+}
 
-	log.Debug().Str("name", name).Str("image", image).Str("id", id).Msg("container created")
+func (d *dockerRuntime) Exec(ctx context.Context, id string, spec ExecSpec, stdout, stderr io.Writer) (int, error) {
+	resp, err := d.cli.ContainerExecCreate(ctx, id, container.ExecOptions{
+		AttachStdout: true,
+		AttachStderr: true,
+		Cmd:          spec.Cmd,
+		Env:          spec.Env,
+		Privileged:   spec.Privileged,
+	})
+	if err != nil {
+		return -1, err
+	}
 
-	err = docker_cli.ContainerStart(context.Background(), id, container.StartOptions{})
+	outresp, err := d.cli.ContainerExecAttach(ctx, resp.ID, container.ExecStartOptions{})
+	if err != nil {
+		return -1, err
+	}
+	defer outresp.Close()
 
+	_, err = stdcopy.StdCopy(stdout, stderr, outresp.Reader)
 	if err != nil {
-		log.Err(err).Str("name", name).Str("image", image).Str("id", id).Msg("container start error")
-		return false, ""
+		// the exit code below is what decides the step
+		log.Err(err).Str("id", id).Str("exec_id", resp.ID).Msg("container exec copy error")
 	}
 
-	log.Debug().Str("name", name).Str("image", image).Str("id", id).Msg("container started")
+	inspectResp, err := d.cli.ContainerExecInspect(ctx, resp.ID)
+	if err != nil {
+		return -1, err
+	}
 
-	return true, id
+	return inspectResp.ExitCode, nil
 }
 
-func CleanContainer(id string) {
-	var timeout = 1
-	err := docker_cli.ContainerStop(context.Background(), id, container.StopOptions{Timeout: &timeout})
-	// err := docker_cli.ContainerRemove(context.Background(), id, container.RemoveOptions{Force: true, RemoveVolumes: true})
+func (d *dockerRuntime) Logs(ctx context.Context, id string) (string, error) {
+	resp, err := d.cli.ContainerLogs(ctx, id, container.LogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+	})
 	if err != nil {
-		log.Err(err).Str("id", id).Msg("container remove error")
-		return
+		return "", err
 	}
-	log.Debug().Str("id", id).Msg("container removed")
-}
+	defer resp.Close()
 
-func GetContainerIP(id string) string {
-	info, err := docker_cli.ContainerInspect(context.Background(), id)
+	var buf bytes.Buffer
+	_, err = stdcopy.StdCopy(&buf, &buf, resp)
 	if err != nil {
-		log.Err(err).Str("id", id).Msg("failed to get ip: container inspect error")
-		return ""
+		return "", err
 	}
-
-	return info.NetworkSettings.IPAddress
+	return buf.String(), nil
 }
 
-func ExecContainer(id string, cmd string, timeout int, stdout, stderr io.Writer, env []string, privileged bool) (int, string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
-	defer cancel()
-
-	resp, err := docker_cli.ContainerExecCreate(ctx, id, container.ExecOptions{
-		AttachStdout: true,
-		AttachStderr: true,
-		Cmd:          []string{"sh", "-c", cmd},
-		Env:          env,
-		Privileged:   privileged,
-	})
+func (d *dockerRuntime) Stop(ctx context.Context, id string, timeout int) error {
+	err := d.cli.ContainerStop(ctx, id, container.StopOptions{Timeout: &timeout})
+	if err != nil || !d.podman {
+		return err
+	}
+	return d.cli.ContainerRemove(ctx, id, container.RemoveOptions{Force: true, RemoveVolumes: true})
+}
 
+func (d *dockerRuntime) Inspect(ctx context.Context, id string) (ContainerInfo, error) {
+	info, err := d.cli.ContainerInspect(ctx, id)
 	if err != nil {
-		log.Err(err).Str("id", id).Msg("container exec create error")
-		return -1, "", err
+		return ContainerInfo{}, err
 	}
 
-	log.Debug().Str("id", id).Str("exec_id", resp.ID).Msg("container exec created")
+	ci := ContainerInfo{
+		ID:    info.ID,
+		Name:  strings.TrimPrefix(info.Name, "/"),
+		Image: info.Config.Image,
+	}
+	if created, err := time.Parse(time.RFC3339Nano, info.Created); err == nil {
+		ci.Created = created
+	}
+	if info.State != nil {
+		ci.Running = info.State.Running
+	}
+	if info.NetworkSettings != nil {
+		ci.IP = info.NetworkSettings.IPAddress
+	}
+	return ci, nil
+}
 
-	outresp, err := docker_cli.ContainerExecAttach(ctx, resp.ID, container.ExecStartOptions{})
+func (d *dockerRuntime) List(ctx context.Context, prefix string) ([]ContainerInfo, error) {
+	// the name filter matches anywhere in the name
+	list, err := d.cli.ContainerList(ctx, container.ListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("name", prefix)),
+	})
 	if err != nil {
-		log.Err(err).Str("id", id).Str("exec_id", resp.ID).Msg("container exec attach error")
-		return -1, "", err
+		return nil, err
 	}
-	defer outresp.Close()
-
-	log.Debug().Str("id", id).Str("exec_id", resp.ID).Msg("container exec started")
 
-	buf := bytes.NewBuffer(nil)
-	if stdout != nil && stderr != nil {
-		_, err := stdcopy.StdCopy(stdout, stderr, io.TeeReader(outresp.Reader, buf))
-		if err != nil {
-			log.Err(err).Str("id", id).Str("exec_id", resp.ID).Msg("container exec copy error")
-		}
-	} else {
-		_, err = io.Copy(buf, outresp.Reader)
-		if err != nil {
-			log.Err(err).Str("id", id).Str("exec_id", resp.ID).Msg("container exec copy error")
+	var res []ContainerInfo
+	for _, c := range list {
+		for _, name := range c.Names {
+			name = strings.TrimPrefix(name, "/")
+			if !strings.HasPrefix(name, prefix) {
+				continue
+			}
+			res = append(res, ContainerInfo{
+				ID:      c.ID,
+				Name:    name,
+				Image:   c.Image,
+				Running: c.State == "running",
+				Created: time.Unix(c.Created, 0),
+			})
+			break
 		}
 	}
+	return res, nil
+}
 
-	inspectResp, err := docker_cli.ContainerExecInspect(ctx, resp.ID)
+func (d *dockerRuntime) CreateNetwork(ctx context.Context, name string, internal bool) (string, error) {
+	resp, err := d.cli.NetworkCreate(ctx, name, dnetwork.CreateOptions{
+		Driver:   "bridge",
+		Internal: internal,
+	})
 	if err != nil {
-		log.Err(err).Str("id", id).Str("exec_id", resp.ID).Msg("container exec inspect error")
-		return -1, "", err
+		return "", err
 	}
+	return resp.ID, nil
+}
 
-	return inspectResp.ExitCode, buf.String(), err
+func (d *dockerRuntime) RemoveNetwork(ctx context.Context, id string) error {
+	return d.cli.NetworkRemove(ctx, id)
 }
 
-func GetContainerLogs(id string) (string, error) {
-	resp, err := docker_cli.ContainerLogs(context.Background(), id, container.LogsOptions{
-		ShowStdout: true,
-		ShowStderr: true,
+func (d *dockerRuntime) ListNetworks(ctx context.Context, prefix string) ([]NetworkInfo, error) {
+	list, err := d.cli.NetworkList(ctx, dnetwork.ListOptions{
+		Filters: filters.NewArgs(filters.Arg("name", prefix)),
 	})
 	if err != nil {
-		log.Err(err).Str("id", id).Msg("container logs error")
-		return "", err
+		return nil, err
 	}
 
-	res, err := io.ReadAll(resp)
+	var res []NetworkInfo
+	for _, n := range list {
+		if strings.HasPrefix(n.Name, prefix) {
+			res = append(res, NetworkInfo{ID: n.ID, Name: n.Name, Created: n.Created})
+		}
+	}
+	return res, nil
+}
 
+func (d *dockerRuntime) ImageInspect(ctx context.Context, image string) (ImageInfo, error) {
+	info, _, err := d.cli.ImageInspectWithRaw(ctx, image)
 	if err != nil {
-		log.Err(err).Str("id", id).Msg("container logs read error")
-		return "", err
+		return ImageInfo{}, err
+	}
+	return ImageInfo{ID: info.ID, RepoDigests: info.RepoDigests}, nil
+}
+
+func (d *dockerRuntime) Pull(ctx context.Context, image string) error {
+	resp, err := d.cli.ImagePull(ctx, image, dimage.PullOptions{})
+	if err != nil {
+		return err
 	}
+	defer resp.Close()
 
-	return string(res), nil
+	// the pull is only done once its progress stream has been read to the end
+	_, err = io.Copy(io.Discard, resp)
+	return err
 }
@@ -14,12 +14,49 @@ import (
 	ssh "github.com/gliderlabs/ssh"
 )
 
+// sftp containers of open sessions, see SftpLive
+var (
+	sftpLive   = map[string]struct{}{}
+	sftpLiveMu sync.Mutex
+)
+
+// SftpLive reports whether the sftp container called name serves an open session.
+func SftpLive(name string) bool {
+	sftpLiveMu.Lock()
+	defer sftpLiveMu.Unlock()
+	_, ok := sftpLive[name]
+	return ok
+}
+
 // SftpHandler handler for SFTP subsystem
 func SftpHandler(sess ssh.Session) {
+	metricSftpSessions.Inc()
+	metricSftpActive.Inc()
+	defer metricSftpActive.Dec()
+
+	switch cfg.SftpMode {
+	case "container":
+		sftpContainer(sess)
+	default:
+		serveSftp(sess)
+	}
+}
+
+// sftpContainer serves the session from a soj-subsystem-sftp container.
+func sftpContainer(sess ssh.Session) {
 	name := "soj-subsystem-sftp-" + sess.User() + "-" + time.Now().Format("20060102150405")
 	path := cfg.SubmitsDir + "/" + sess.User()
 	log.Println("new sftp session", sess.User(), name, path)
 
+	sftpLiveMu.Lock()
+	sftpLive[name] = struct{}{}
+	sftpLiveMu.Unlock()
+	defer func() {
+		sftpLiveMu.Lock()
+		delete(sftpLive, name)
+		sftpLiveMu.Unlock()
+	}()
+
 	if err := os.MkdirAll(path, 0700); err != nil {
 		log.Println(name, "failed to create working dir", path, err)
 		return
@@ -27,25 +64,43 @@ func SftpHandler(sess ssh.Session) {
 
 	os.Chown(path, cfg.SubmitUid, cfg.SubmitGid)
 
-	success, id := RunImage(name, strconv.Itoa(cfg.SubmitUid), "soj-sftpd", "docker.io/mrhaoxx/soj-subsystem-sftp", "/", []mount.Mount{
-		{
-			Type:   mount.TypeBind,
-			Source: path,
-			Target: "/work",
+	success, id := RunImage(sess.Context(), ContainerSpec{
+		Name:     name,
+		User:     strconv.Itoa(cfg.SubmitUid),
+		Hostname: "soj-sftpd",
+		Image:    "docker.io/mrhaoxx/soj-subsystem-sftp",
+		WorkDir:  "/",
+		Mounts: []mount.Mount{
+			{
+				Type:   mount.TypeBind,
+				Source: path,
+				Target: "/work",
+			},
 		},
-	}, true, true, false, 120, false, nil)
+		MaskPaths:      true,
+		ReadonlyRootfs: true,
+		StopTimeout:    120,
+	})
 
 	if !success {
 		log.Println(name, "failed to run sftp container")
 		return
 	}
-	// defer CleanContainer(id)
-
-	// time.Sleep(500 * time.Millisecond)
+	defer CleanContainer(id)
 
 	ip := GetContainerIP(id)
+	if ip == "" {
+		log.Println(name, "no ip for container", id)
+		return
+	}
+
+	addr, err := netip.ParseAddrPort(ip + ":2207")
+	if err != nil {
+		log.Println(name, "invalid container address", id, err)
+		return
+	}
 
-	conn, err := net.DialTCP("tcp", nil, net.TCPAddrFromAddrPort(netip.MustParseAddrPort(ip+":2207")))
+	conn, err := net.DialTCP("tcp", nil, net.TCPAddrFromAddrPort(addr))
 	if err != nil {
 		log.Println(name, "failed to connect to container", id, err)
 		return
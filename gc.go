@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// gcGrace protects containers and dirs that are just being set up or
+// torn down by their owner.
+const gcGrace = time.Minute
+
+type GCReport struct {
+	Containers []string // names of the stopped containers
+	Networks   []string // names of the removed networks
+	Workdirs   []string // removed dirs below SubmitWorkDir
+	Freed      int64    // bytes in the removed dirs
+
+	Usage []DiskUsage
+}
+
+type DiskUsage struct {
+	Name  string
+	Dir   string
+	Bytes int64
+	Files int64
+}
+
+// RunGCLoop collects garbage every GCInterval minutes.
+func RunGCLoop() {
+	interval := cfg.GCInterval
+	if interval < 0 {
+		return
+	}
+	if interval == 0 {
+		interval = 10
+	}
+
+	for {
+		rep := RunGC(context.Background())
+		if len(rep.Containers) > 0 || len(rep.Networks) > 0 || len(rep.Workdirs) > 0 {
+			log.Info().Strs("containers", rep.Containers).Strs("networks", rep.Networks).Int("workdirs", len(rep.Workdirs)).Int64("freed", rep.Freed).Msg("garbage collected")
+		}
+		time.Sleep(time.Duration(interval) * time.Minute)
+	}
+}
+
+// RunGC stops containers without a live owner, prunes workdirs past
+// WorkdirRetention and measures the disk usage of the data dirs.
+func RunGC(ctx context.Context) GCReport {
+	var rep GCReport
+
+	reapContainers(ctx, "soj-judge-", judgeContainerLive, &rep)
+	reapContainers(ctx, "soj-subsystem-sftp-", SftpLive, &rep)
+	reapNetworks(ctx, &rep)
+	pruneWorkdirs(&rep)
+
+	rep.Usage = append(rep.Usage, diskUsage("submits", cfg.SubmitsDir))
+	rep.Usage = append(rep.Usage, diskUsage("workdirs", cfg.SubmitWorkDir))
+	rep.Usage = append(rep.Usage, diskUsage("snapshots", cfg.SnapshotsDir()))
+	if cfg.LogDir != "" {
+		rep.Usage = append(rep.Usage, diskUsage("logs", cfg.LogDir))
+	}
+	for _, u := range rep.Usage {
+		metricDiskUsage.WithLabelValues(u.Name).Set(float64(u.Bytes))
+	}
+
+	return rep
+}
+
+func reapContainers(ctx context.Context, prefix string, live func(name string) bool, rep *GCReport) {
+	list, err := container_runtime.List(ctx, prefix)
+	if err != nil {
+		log.Err(err).Str("prefix", prefix).Msg("gc: container list error")
+		metricDockerErrors.WithLabelValues("list").Inc()
+		return
+	}
+
+	for _, c := range list {
+		if time.Since(c.Created) < gcGrace || live(c.Name) {
+			continue
+		}
+
+		log.Info().Str("name", c.Name).Str("id", c.ID).Bool("running", c.Running).Msg("gc: stopping orphaned container")
+		// Stop also removes exited containers
+		err := container_runtime.Stop(ctx, c.ID, 1)
+		if err != nil {
+			log.Err(err).Str("name", c.Name).Str("id", c.ID).Msg("gc: container stop error")
+			metricDockerErrors.WithLabelValues("stop").Inc()
+			continue
+		}
+		metricContainersReaped.Inc()
+		rep.Containers = append(rep.Containers, c.Name)
+	}
+}
+
+// judgeContainerLive reports whether the judge container called name,
+// soj-judge-<submit id>-<...> or soj-judge-warm-<...>, is in use.
+func judgeContainerLive(name string) bool {
+	name = strings.TrimPrefix(name, "soj-judge-")
+	if strings.HasPrefix(name, "warm-") {
+		return WarmLive(name)
+	}
+
+	id, _, _ := strings.Cut(name, "-")
+	return submissionLive(id)
+}
+
+func reapNetworks(ctx context.Context, rep *GCReport) {
+	list, err := container_runtime.ListNetworks(ctx, judgeNetworkPrefix)
+	if err != nil {
+		log.Err(err).Msg("gc: network list error")
+		metricDockerErrors.WithLabelValues("list_networks").Inc()
+		return
+	}
+
+	for _, n := range list {
+		if time.Since(n.Created) < gcGrace || submissionLive(strings.TrimPrefix(n.Name, judgeNetworkPrefix)) {
+			continue
+		}
+
+		log.Info().Str("name", n.Name).Str("id", n.ID).Msg("gc: removing orphaned network")
+		err := container_runtime.RemoveNetwork(ctx, n.ID)
+		if err != nil {
+			log.Err(err).Str("name", n.Name).Str("id", n.ID).Msg("gc: network remove error")
+			metricDockerErrors.WithLabelValues("remove_network").Inc()
+			continue
+		}
+		rep.Networks = append(rep.Networks, n.Name)
+	}
+}
+
+// submissionLive reports whether the submission is still being judged.
+func submissionLive(id string) bool {
+	var sub SubmitCtx
+	tx := db.Select("id", "status").Where("id = ?", id).Limit(1).Find(&sub)
+	if tx.Error != nil {
+		// when in doubt, keep it
+		log.Err(tx.Error).Str("id", id).Msg("gc: failed to look up submission")
+		return true
+	}
+	if tx.RowsAffected == 0 {
+		return false
+	}
+	switch sub.Status {
+	case "completed", "failed", "dead":
+		return false
+	}
+	return true
+}
+
+func pruneWorkdirs(rep *GCReport) {
+	entries, err := os.ReadDir(cfg.SubmitWorkDir)
+	if err != nil {
+		log.Err(err).Str("dir", cfg.SubmitWorkDir).Msg("gc: failed to read workdirs")
+		return
+	}
+
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || !e.IsDir() {
+			continue
+		}
+		age := time.Since(info.ModTime())
+
+		if strings.HasPrefix(e.Name(), "warm-") {
+			if age < gcGrace || WarmLive(e.Name()) {
+				continue
+			}
+		} else {
+			if cfg.WorkdirRetention <= 0 || age < time.Duration(cfg.WorkdirRetention)*24*time.Hour || submissionLive(e.Name()) {
+				continue
+			}
+		}
+
+		dir := path.Join(cfg.SubmitWorkDir, e.Name())
+		size := diskUsage("", dir).Bytes
+		err = os.RemoveAll(dir)
+		if err != nil {
+			log.Err(err).Str("dir", dir).Msg("gc: failed to remove workdir")
+			continue
+		}
+		log.Debug().Str("dir", dir).Int64("bytes", size).Msg("gc: removed workdir")
+		rep.Workdirs = append(rep.Workdirs, e.Name())
+		rep.Freed += size
+	}
+}
+
+func diskUsage(name, dir string) DiskUsage {
+	u := DiskUsage{Name: name, Dir: dir}
+	filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if !d.IsDir() {
+			u.Files++
+		}
+		u.Bytes += info.Size()
+		return nil
+	})
+	return u
+}
+
+// FormatBytes renders n with a binary unit, e.g. 1.5 GiB.
+func FormatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return strconv.FormatInt(n, 10) + " B"
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return strconv.FormatFloat(float64(n)/float64(div), 'f', 1, 64) + " " + string("KMGTPE"[exp]) + "iB"
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	ssh "github.com/gliderlabs/ssh"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/plumbing/format/pktline"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/capability"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/sideband"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/logrusorgru/aurora/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// GitReceivePack serves `git push ssh://soj/<problem_id>`. The files of
+// the pushed commit named in Problem.Submits are written to the problem's
+// submit directory and judged, with the judge output sent back as remote
+// messages. No refs are kept, every push starts from an empty repository.
+func GitReceivePack(s ssh.Session, tctx context.Context) {
+	cmds := s.Command()
+
+	fatal := func(a ...interface{}) {
+		fmt.Fprintln(s.Stderr(), a...)
+		s.Exit(1)
+	}
+
+	if len(cmds) != 2 {
+		fatal("usage: git push ssh://<host>/<problem_id>")
+		return
+	}
+	pid := strings.TrimSuffix(strings.Trim(cmds[1], "/"), ".git")
+
+	pb, ok := CurrentProblems()[pid]
+	if !ok {
+		fatal("problem", strconv.Quote(pid), "not found")
+		return
+	}
+	if paused {
+		fatal("submit is paused. Please try again later")
+		return
+	}
+
+	adv := packp.NewAdvRefs()
+	adv.Capabilities.Set(capability.ReportStatus)
+	adv.Capabilities.Set(capability.Sideband64k)
+	adv.Capabilities.Set(capability.Sideband)
+	adv.Capabilities.Set(capability.OFSDelta)
+	adv.Capabilities.Set(capability.Agent, "soj")
+	if err := adv.Encode(s); err != nil {
+		log.Err(err).Str("user", s.User()).Msg("git: failed to advertise refs")
+		return
+	}
+
+	req := packp.NewReferenceUpdateRequest()
+	err := req.Decode(s)
+	if err == packp.ErrEmpty {
+		// nothing to push
+		return
+	}
+	if err != nil {
+		log.Err(err).Str("user", s.User()).Msg("git: bad update request")
+		fatal("bad update request:", err)
+		return
+	}
+
+	st := memory.NewStorage()
+	rs := packp.NewReportStatus()
+	rs.UnpackStatus = "ok"
+	if req.Packfile != nil {
+		// the pack is unpacked in memory
+		lr := &io.LimitedReader{R: req.Packfile, N: ArchiveLimit() + 1}
+		err := packfile.UpdateObjectStorage(st, lr)
+		if lr.N <= 0 {
+			err = fmt.Errorf("pack exceeds %d bytes", ArchiveLimit())
+		}
+		if err != nil {
+			log.Err(err).Str("user", s.User()).Msg("git: failed to unpack")
+			rs.UnpackStatus = err.Error()
+		}
+	}
+
+	var mux *sideband.Muxer
+	var out io.Writer = s.Stderr()
+	switch {
+	case req.Capabilities.Supports(capability.Sideband64k):
+		mux = sideband.NewMuxer(sideband.Sideband64k, s)
+	case req.Capabilities.Supports(capability.Sideband):
+		mux = sideband.NewMuxer(sideband.Sideband, s)
+	}
+	if mux != nil {
+		out = gitProgress{mux}
+	}
+
+	var judged bool
+	for _, cmd := range req.Commands {
+		status := "ok"
+		switch {
+		case rs.UnpackStatus != "ok":
+			status = "unpacker error"
+		case cmd.Action() == packp.Delete:
+			status = "deleting is not supported"
+		case judged:
+			status = "only one ref is judged per push"
+		default:
+			judged = true
+			if err := gitSubmit(s, tctx, out, st, cmd.New, &pb); err != nil {
+				status = err.Error()
+			}
+		}
+		rs.CommandStatuses = append(rs.CommandStatuses, &packp.CommandStatus{ReferenceName: cmd.Name, Status: status})
+	}
+
+	if req.Capabilities.Supports(capability.ReportStatus) {
+		if mux != nil {
+			rs.Encode(mux)
+			pktline.NewEncoder(s).Flush()
+		} else {
+			rs.Encode(s)
+		}
+	}
+	s.Exit(0)
+}
+
+// gitProgress writes remote messages.
+type gitProgress struct {
+	*sideband.Muxer
+}
+
+func (p gitProgress) Write(b []byte) (int, error) {
+	return p.WriteChannel(sideband.ProgressMessage, b)
+}
+
+// gitSubmit checks out commit into the submit directory and judges it.
+// Errors are short enough for the report status.
+func gitSubmit(s ssh.Session, tctx context.Context, out io.Writer, st *memory.Storage, commit plumbing.Hash, pb *Problem) error {
+	uf := Userface{Buffer: bytes.NewBuffer(nil), Writer: out}
+
+	c, err := object.GetCommit(st, commit)
+	if err != nil {
+		return fmt.Errorf("commit %s not found", commit)
+	}
+	tree, err := c.Tree()
+	if err != nil {
+		return fmt.Errorf("tree of %s not found", commit)
+	}
+
+	uf.Println(aurora.Green("Submitting"), aurora.Bold(pb.Id), "at", aurora.Yellow(commit.String()[:12]), aurora.Italic(strings.SplitN(c.Message, "\n", 2)[0]))
+
+	err = CheckoutSubmits(s.User(), pb, tree)
+	if err == errQuota {
+		uf.Println(aurora.Red("error:"), "the pushed files do not fit in your quota")
+		return fmt.Errorf("disk quota exceeded")
+	}
+	if err != nil {
+		uf.Println(aurora.Red("error:"), err)
+		return err
+	}
+
+	ctx := NewSubmitCtx(tctx, s.User(), pb, out)
+	ctx.Commit = commit.String()
+
+	go RunJudge(ctx)
+
+	<-ctx.running
+
+	uf.Println("Submit", "is", ColorizeStatus(ctx.Status))
+	uf.Println("Message:\n	", aurora.Blue(ctx.Msg))
+
+	WriteResult(uf, *ctx)
+
+	UserUpdate(s.User(), *ctx)
+	return nil
+}
+
+// CheckoutSubmits writes the files of tree named in pb.Submits to
+// SubmitsDir/<user>/<problem>, replacing what is there. The workspace is
+// snapshotted first.
+func CheckoutSubmits(user string, pb *Problem, tree *object.Tree) error {
+	dst := path.Join(cfg.SubmitsDir, user, pb.Id)
+
+	type checkout struct {
+		dst  string
+		file *object.File
+	}
+	var files []checkout
+	var replaced, names []string
+	var size int64
+
+	for _, submit := range pb.Submits {
+		p := path.Clean(submit.Path)
+		replaced = append(replaced, p)
+
+		if !submit.IsDir {
+			f, err := tree.File(p)
+			if err != nil {
+				return fmt.Errorf("%s not found in commit", p)
+			}
+			files = append(files, checkout{path.Join(dst, p), f})
+			names = append(names, p)
+			size += f.Size
+			continue
+		}
+
+		t, err := tree.Tree(p)
+		if err != nil {
+			return fmt.Errorf("directory %s not found in commit", p)
+		}
+		err = t.Files().ForEach(func(f *object.File) error {
+			if !fs.ValidPath(f.Name) {
+				return fmt.Errorf("invalid path %s", strconv.Quote(f.Name))
+			}
+			// symlinks are left out, they could lead anywhere
+			if f.Mode != filemode.Regular && f.Mode != filemode.Executable && f.Mode != filemode.Deprecated {
+				return nil
+			}
+			files = append(files, checkout{path.Join(dst, p, f.Name), f})
+			names = append(names, path.Join(p, f.Name))
+			size += f.Size
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if !fitsQuota(user, dst, replaced, names, size) {
+		return errQuota
+	}
+
+	if _, err := TakeSnapshot(user, pb.Id, "push", ""); err != nil {
+		log.Err(err).Str("user", user).Str("problem", pb.Id).Msg("git: failed to snapshot workspace")
+	}
+
+	defer rescanQuota(user)
+
+	if err := mkdirOwned(dst); err != nil {
+		return fmt.Errorf("failed to create submit directory")
+	}
+	for _, submit := range pb.Submits {
+		if err := os.RemoveAll(path.Join(dst, path.Clean(submit.Path))); err != nil {
+			return fmt.Errorf("failed to replace %s", submit.Path)
+		}
+	}
+
+	for _, c := range files {
+		mkdirOwned(path.Dir(c.dst))
+		if err := writeGitFile(c.dst, c.file); err != nil {
+			log.Err(err).Str("user", user).Str("file", c.dst).Msg("git: failed to check out file")
+			return fmt.Errorf("failed to write %s", c.file.Name)
+		}
+	}
+	return nil
+}
+
+func writeGitFile(dst string, f *object.File) error {
+	mode := os.FileMode(0600)
+	if f.Mode == filemode.Executable {
+		mode = 0700
+	}
+
+	r, err := f.Reader()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	w, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	w.Chown(cfg.SubmitUid, cfg.SubmitGid)
+
+	_, err = io.Copy(w, r)
+	return err
+}
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"os"
+	"path"
 	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/rs/zerolog/log"
@@ -28,7 +31,7 @@ func listSubmitsHandler(c *gin.Context) {
 
 	var submits []SubmitCtx
 	var total int64
-	db.Select("id", "user", "problem", "submit_time", "last_update", "status", "msg", "judge_result").
+	db.Select(submitListColumns).
 		Order("submit_time desc").
 		Offset((page - 1) * limit).Limit(limit).
 		Find(&submits)
@@ -57,6 +60,52 @@ func listRankHandler(c *gin.Context) {
 	})
 }
 
+// attachmentsHandler
+// serves the attachments of a problem, a file list for the directory itself
+// does not need to be authenticated
+func attachmentsHandler(c *gin.Context) {
+	pb, ok := CurrentProblems()[c.Param("id")]
+	if !ok || pb.Attachments == "" {
+		c.JSON(404, gin.H{
+			"message": "Problem or attachments not found",
+		})
+		return
+	}
+
+	if strings.Trim(c.Param("file"), "/") == "" {
+		files, err := ListAttachments(pb)
+		if err != nil {
+			log.Err(err).Str("problem", pb.Id).Msg("failed to list attachments")
+			c.JSON(500, gin.H{
+				"message": "Failed to list attachments",
+			})
+			return
+		}
+		c.JSON(200, gin.H{
+			"code":    0,
+			"message": "success",
+			"data":    files,
+		})
+		return
+	}
+
+	p, err := AttachmentPath(pb, c.Param("file"))
+	if err == nil {
+		var fi os.FileInfo
+		fi, err = os.Stat(p)
+		if err == nil && !fi.Mode().IsRegular() {
+			err = os.ErrNotExist
+		}
+	}
+	if err != nil {
+		c.JSON(404, gin.H{
+			"message": "Attachment not found",
+		})
+		return
+	}
+	c.FileAttachment(p, path.Base(p))
+}
+
 func serveHTTP(addr string) {
 	gin.SetMode(gin.ReleaseMode)
 	router := gin.Default()
@@ -68,6 +117,7 @@ func serveHTTP(addr string) {
 
 	router.GET("/api/v1/submits/list", listSubmitsHandler)
 	router.GET("/api/v1/rank/list", listRankHandler)
+	router.GET("/api/v1/problems/:id/attachments/*file", attachmentsHandler)
 
 	go func() {
 		log.Info().Str("addr", addr).Msg("HTTP server started")
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/distribution/reference"
+	"github.com/rs/zerolog/log"
+)
+
+type ImageInfo struct {
+	ID          string   // content hash of the local image config, sha256:...
+	RepoDigests []string // e.g. docker.io/library/debian@sha256:...
+}
+
+// ResolveImage pins image to the exact content available locally.
+// It returns a reference to create the container from, which no longer
+// follows the tag, and the digest recorded on the submission.
+// Images already pinned with image@sha256:... resolve to themselves.
+func ResolveImage(ctx context.Context, image string) (ref string, digest string, err error) {
+	info, err := container_runtime.ImageInspect(ctx, image)
+	if err != nil {
+		metricDockerErrors.WithLabelValues("image_inspect").Inc()
+		return "", "", err
+	}
+
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "", "", err
+	}
+
+	if canonical, ok := named.(reference.Canonical); ok {
+		return image, canonical.Digest().String(), nil
+	}
+
+	for _, rd := range info.RepoDigests {
+		rnamed, err := reference.ParseNormalizedNamed(rd)
+		if err != nil {
+			continue
+		}
+		if canonical, ok := rnamed.(reference.Canonical); ok && rnamed.Name() == named.Name() {
+			return rd, canonical.Digest().String(), nil
+		}
+	}
+
+	// locally built images have no repo digest, the image ID is just as exact
+	log.Debug().Str("image", image).Str("id", info.ID).Msg("image has no repo digest, pinning to image id")
+	return info.ID, info.ID, nil
+}
+
+// ProblemImages returns every image referenced by problems, judge and
+// service images, in a stable order.
+func ProblemImages(problems map[string]Problem) []string {
+	var seen = map[string]struct{}{}
+	var images []string
+	add := func(image string) {
+		if _, ok := seen[image]; ok || image == "" {
+			return
+		}
+		seen[image] = struct{}{}
+		images = append(images, image)
+	}
+	for _, id := range SortedProblemIds(problems) {
+		for _, w := range problems[id].Workflow {
+			add(w.Image)
+			for _, svc := range w.Services {
+				add(svc.Image)
+			}
+		}
+	}
+	return images
+}
+
+type ImageStatus struct {
+	Image  string
+	Status string // present, pulled or missing
+	Digest string
+	Err    error
+}
+
+// PrepareImages pulls the images that are not available locally.
+func PrepareImages(ctx context.Context, images []string) []ImageStatus {
+	var res []ImageStatus
+	for _, image := range images {
+		st := ImageStatus{Image: image, Status: "present"}
+
+		_, digest, err := ResolveImage(ctx, image)
+		if err != nil {
+			log.Info().Str("image", image).AnErr("err", err).Msg("pulling image")
+			err = container_runtime.Pull(ctx, image)
+			if err != nil {
+				metricDockerErrors.WithLabelValues("pull").Inc()
+				st.Status = "missing"
+				st.Err = err
+				res = append(res, st)
+				continue
+			}
+			st.Status = "pulled"
+			_, digest, err = ResolveImage(ctx, image)
+			if err != nil {
+				st.Status = "missing"
+				st.Err = err
+			}
+		}
+		st.Digest = digest
+		res = append(res, st)
+	}
+	return res
+}
+
+// ShortDigest abbreviates a sha256 digest for display.
+func ShortDigest(digest string) string {
+	d := strings.TrimPrefix(digest, "sha256:")
+	if len(d) > 12 {
+		return "sha256:" + d[:12]
+	}
+	return digest
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
 	"encoding/hex"
 	"encoding/json"
@@ -20,6 +21,8 @@ import (
 	"github.com/rs/zerolog/log"
 
 	"github.com/docker/docker/api/types/mount"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type JudgeResult struct {
@@ -36,14 +39,20 @@ type JudgeResult struct {
 
 type WorkflowResult struct {
 	Success  bool
-	Logs     string
+	LogID    string
 	ExitCode int
 
+	Image       string // as written in the problem
+	ImageDigest string // what the workflow actually ran
+	Security    SecurityRecord
+	Network     string          `json:",omitempty"`
+	Services    []ServiceResult `json:",omitempty"`
+
 	Steps []WorkflowStepResult
 }
 
 type WorkflowStepResult struct {
-	Logs     string
+	LogID    string
 	ExitCode int
 }
 
@@ -76,15 +85,15 @@ type SubmitHash struct {
 }
 type SubmitCtx struct {
 	ID      string `gorm:"primaryKey"`
-	User    string
-	Problem string
+	User    string `gorm:"index"`
+	Problem string `gorm:"index"`
 
 	problem *Problem
 
-	SubmitTime int64
+	SubmitTime int64 `gorm:"index"`
 	LastUpdate int64
 
-	Status string
+	Status string `gorm:"index"`
 	Msg    string
 
 	SubmitDir       string
@@ -95,8 +104,46 @@ type SubmitCtx struct {
 
 	RealWorkdir string
 
-	running  chan struct{}
-	Userface Userface
+	LogID string // judge output shown to the user, kept in the log store
+
+	Commit string // the pushed commit, for submissions by git push
+
+	running chan struct{}
+	tctx    context.Context
+
+	network, networkID string   // see JudgeNetwork
+	Userface           Userface `gorm:"-"`
+}
+
+// NewSubmitCtx prepares a submission of user for pb, judged from the files
+// in SubmitsDir/<user>/<problem>. The judge output goes to out.
+func NewSubmitCtx(tctx context.Context, user string, pb *Problem, out io.Writer) *SubmitCtx {
+	subtime := time.Now()
+
+	id := strconv.Itoa(int(subtime.UnixNano()))
+	return &SubmitCtx{
+		ID:      id,
+		Problem: pb.Id,
+		problem: pb,
+		User:    user,
+
+		SubmitTime: subtime.UnixNano(),
+
+		Status: "init",
+
+		SubmitDir: path.Join(cfg.SubmitsDir, user, pb.Id),
+		Workdir:   path.Join(cfg.SubmitWorkDir, id),
+
+		RealWorkdir: path.Join(cfg.RealSubmitWorkDir, id),
+
+		Userface: Userface{
+			Buffer: bytes.NewBuffer(nil),
+			Writer: out,
+		},
+		// JudgeResult: JudgeResult{Score: -1},
+		running: make(chan struct{}),
+		tctx:    tctx,
+	}
 }
 
 func (ctx *SubmitCtx) Update() {
@@ -161,9 +208,24 @@ func RunJudge(ctx *SubmitCtx) {
 
 	var err error
 
+	metricQueueDepth.Inc()
+
+	if ctx.tctx == nil {
+		ctx.tctx = context.Background()
+	}
+	tctx, span := tracer.Start(ctx.tctx, "RunJudge", submitAttrs(ctx))
+
 	defer func() {
+		span.SetAttributes(attribute.String("soj.submit.status", ctx.Status), attribute.String("soj.submit.msg", ctx.Msg))
+		EndSpan(span, err)
+
+		metricQueueDepth.Dec()
+		metricSubmissions.WithLabelValues(ctx.Problem, ctx.Status).Inc()
+		metricJudgeDuration.WithLabelValues(ctx.Problem).Observe(time.Since(start_time).Seconds())
+
 		log.Debug().Timestamp().Str("id", ctx.ID).Str("status", ctx.Status).Str("judgemsg", ctx.Msg).AnErr("err", err).Msg("judge finished")
 		ctx.Userface.Println(GetTime(start_time), "Submission", ColorizeStatus(ctx.Status))
+		ctx.LogID = SaveLog(ctx.ID, ctx.Userface.String())
 		close(ctx.running)
 
 		ctx.Update()
@@ -173,6 +235,8 @@ func RunJudge(ctx *SubmitCtx) {
 
 	ctx.SetStatus("prep_dirs").Update()
 
+	_, prep_span := tracer.Start(tctx, "prep_dirs")
+
 	var submits_dir = path.Join(ctx.Workdir, "submits")
 	var workflow_dir = path.Join(ctx.Workdir, "work")
 
@@ -208,21 +272,27 @@ func RunJudge(ctx *SubmitCtx) {
 
 workdir_creation_failed:
 
+	EndSpan(prep_span, err)
 	ctx.SetStatus("failed").SetMsg("failed to create submit workdir").Update()
 	return
 
 workdir_created:
 
+	prep_span.End()
+
 	log.Debug().Timestamp().Str("id", ctx.ID).Str("submit_workdir", ctx.Workdir).Msg("created working dirs")
 
 	ctx.Userface.Println(GetTime(start_time), "Submitting files")
 
 	ctx.SetStatus("prep_files").Update()
 
+	files_tctx, files_span := tracer.Start(tctx, "prep_files")
+
 	for _, submit := range ctx.problem.Submits {
 		if !submit.IsDir {
-			err = SubmitFile(ctx, submits_dir, submit.Path)
+			err = SubmitFile(files_tctx, ctx, submits_dir, submit.Path)
 			if err != nil {
+				EndSpan(files_span, err)
 				ctx.SetStatus("failed").SetMsg("failed to copy submit file " + strconv.Quote(submit.Path)).Update()
 				ctx.Userface.Println("	*", aurora.Yellow(submit.Path), ":", aurora.Red("failed"))
 				return
@@ -241,11 +311,12 @@ workdir_created:
 					}
 					// path: eg: subfolder/main.cpp
 					// final file path: src/subfolder/main.cpp
-					return SubmitFile(ctx, submits_dir, submit.Path+"/"+path) // Concatenate with submit.Path
+					return SubmitFile(files_tctx, ctx, submits_dir, submit.Path+"/"+path) // Concatenate with submit.Path
 				}
 				return nil
 			})
 			if err != nil {
+				EndSpan(files_span, err)
 				ctx.SetStatus("failed").SetMsg("failed to copy submit directory " + strconv.Quote(submit.Path)).Update()
 				ctx.Userface.Println("	*", aurora.Yellow(submit.Path), ":", aurora.Red("failed"))
 				return
@@ -253,48 +324,27 @@ workdir_created:
 		}
 	}
 
+	files_span.End()
+
 	log.Debug().Timestamp().Str("id", ctx.ID).Msg("copied submit files")
 
+	if ctx.SubmitDir == path.Join(cfg.SubmitsDir, ctx.User, ctx.Problem) {
+		_, err := TakeSnapshot(ctx.User, ctx.Problem, "submit", ctx.ID)
+		if err != nil {
+			log.Err(err).Str("id", ctx.ID).Msg("failed to snapshot workspace")
+		}
+	}
+
 	ctx.Userface.Println(GetTime(start_time), "Running Judge workflows")
 
 	ctx.SetStatus("run_workflow").Update()
 
-	for idx, workflow := range ctx.problem.Workflow {
-
-		var _mount = []mount.Mount{
-			{
-				Type:     mount.TypeBind,
-				Source:   submits_dir,
-				Target:   "/submits",
-				ReadOnly: true,
-			},
-			{
-				Type:   mount.TypeBind,
-				Source: workflow_dir,
-				Target: "/work",
-			},
-		}
-
-		var envs = []string{
-			"SOJ_SUBMITS_DIR=/submits",
-			"SOJ_WORK_DIR=/work",
-			"SOJ_REAL_WORKDIR=" + rworkflow_dir,
-			"SOJ_REAL_SUBMITDIR=" + rsubmits_dir,
-			// "SOJ_USER=" + ctx.User,
-			"SOJ_PROBLEM=" + ctx.Problem,
-			"SOJ_SUBMIT=" + ctx.ID,
-			"SOJ_WORK_UID=" + strconv.Itoa(cfg.SubmitUid),
-			"SOJ_WORK_GID=" + strconv.Itoa(cfg.SubmitGid),
-		}
+	// after the containers on it are gone
+	defer ctx.RemoveJudgeNetwork()
 
-		for _, mnt := range workflow.Mounts {
-			_mount = append(_mount, mount.Mount{
-				Type:     mount.Type(mnt.Type),
-				Source:   mnt.Source,
-				Target:   mnt.Target,
-				ReadOnly: mnt.ReadOnly,
-			})
-		}
+	for idx, workflow := range ctx.problem.Workflow {
+		workflow_start := time.Now()
+		wf_tctx, wf_span := tracer.Start(tctx, "workflow", trace.WithAttributes(attribute.Int("soj.workflow", idx+1), attribute.String("soj.workflow.image", workflow.Image)))
 
 		ctx.SetStatus("run_workflow-" + strconv.Itoa(idx)).Update()
 		ctx.Userface.Println(GetTime(start_time), "running", "workflow", strconv.Itoa(idx+1), "/", len(ctx.problem.Workflow))
@@ -309,20 +359,124 @@ workdir_created:
 			stepprivillege[step] = struct{}{}
 		}
 
-		var usr = strconv.Itoa(cfg.SubmitUid)
+		spec := JudgeSpec(workflow)
 
-		if workflow.Root {
-			usr = "0"
-		}
+		wr := WorkflowResult{Image: workflow.Image}
 
-		ok, cid := RunImage("soj-judge-"+ctx.ID+"-"+strconv.Itoa(idx+1), usr, "soj-judgement", workflow.Image, "/work", _mount, false, false, workflow.DisableNetwork, workflow.Timeout, workflow.NetworkHostMode, envs)
+		spec.Image, wr.ImageDigest, err = ResolveImage(wf_tctx, workflow.Image)
+		if err != nil {
+			log.Info().Timestamp().Str("id", ctx.ID).Str("image", workflow.Image).AnErr("err", err).Msg("failed to resolve judge image")
+			EndSpan(wf_span, err)
+			ctx.WorkflowResults = append(ctx.WorkflowResults, wr)
+			ctx.SetStatus("failed").SetMsg("judge image " + strconv.Quote(workflow.Image) + " is not available").Update()
+			return
+		}
+		wf_span.SetAttributes(attribute.String("soj.workflow.image_digest", wr.ImageDigest))
 
-		if !ok {
-			ctx.SetStatus("failed").SetMsg("failed to run judge container").Update()
+		wr.Security, err = workflow.Security.Apply(&spec)
+		if err != nil {
+			log.Info().Timestamp().Str("id", ctx.ID).Str("seccomp", workflow.Security.Seccomp).AnErr("err", err).Msg("failed to load security profile")
+			EndSpan(wf_span, err)
+			ctx.WorkflowResults = append(ctx.WorkflowResults, wr)
+			ctx.SetStatus("failed").SetMsg("failed to load judge security profile").Update()
 			return
 		}
 
-		defer CleanContainer(cid)
+		var services serviceSet
+		defer services.Stop()
+
+		if workflow.Isolated() {
+			if workflow.DisableNetwork || workflow.NetworkHostMode {
+				err = errors.New("isolated workflows can not disable the network or use host mode")
+				EndSpan(wf_span, err)
+				ctx.WorkflowResults = append(ctx.WorkflowResults, wr)
+				ctx.SetStatus("failed").SetMsg("invalid judge network settings").Update()
+				return
+			}
+
+			spec.Network, err = ctx.JudgeNetwork(wf_tctx)
+			if err != nil {
+				EndSpan(wf_span, err)
+				ctx.WorkflowResults = append(ctx.WorkflowResults, wr)
+				ctx.SetStatus("failed").SetMsg("failed to create judge network").Update()
+				return
+			}
+			spec.NetworkAliases = []string{"judge"}
+			wr.Network = spec.Network
+
+			for _, svc := range workflow.Services {
+				ctx.Userface.Println(GetTime(start_time), "starting", "service", aurora.Cyan(svc.Name))
+				sid, rec, err := StartService(wf_tctx, ctx, idx, svc, spec.Network)
+				wr.Services = append(wr.Services, rec)
+				if err != nil {
+					log.Info().Timestamp().Str("id", ctx.ID).Str("service", svc.Name).Str("image", svc.Image).AnErr("err", err).Msg("failed to start service")
+					EndSpan(wf_span, err)
+					ctx.WorkflowResults = append(ctx.WorkflowResults, wr)
+					ctx.SetStatus("failed").SetMsg("failed to start service " + strconv.Quote(svc.Name)).Update()
+					return
+				}
+				services = append(services, sid)
+			}
+		}
+
+		var cid string
+		var real_submits_dir, real_workflow_dir = rsubmits_dir, rworkflow_dir
+
+		var wc *WarmContainer
+		if spec.Network == "" {
+			// warm containers are already on the default network
+			wc = TakeWarm(spec, cfg.WarmPool[workflow.Image])
+		}
+		if wc != nil {
+			err = wc.Attach(ctx.Workdir)
+			if err != nil {
+				log.Err(err).Str("id", ctx.ID).Str("container", wc.ID).Msg("failed to attach submission to warm container")
+				wc.Release()
+				wc = nil
+			}
+		}
+		wf_span.SetAttributes(attribute.Bool("soj.workflow.warm", wc != nil))
+
+		if wc != nil {
+			defer wc.Release()
+			cid = wc.ID
+			real_submits_dir = path.Join(wc.RealDir, "submits")
+			real_workflow_dir = path.Join(wc.RealDir, "work")
+		}
+
+		var envs = []string{
+			"SOJ_SUBMITS_DIR=/submits",
+			"SOJ_WORK_DIR=/work",
+			"SOJ_REAL_WORKDIR=" + real_workflow_dir,
+			"SOJ_REAL_SUBMITDIR=" + real_submits_dir,
+			// "SOJ_USER=" + ctx.User,
+			"SOJ_PROBLEM=" + ctx.Problem,
+			"SOJ_SUBMIT=" + ctx.ID,
+			"SOJ_WORK_UID=" + strconv.Itoa(cfg.SubmitUid),
+			"SOJ_WORK_GID=" + strconv.Itoa(cfg.SubmitGid),
+		}
+		if ctx.problem.Attachments != "" {
+			envs = append(envs, "SOJ_ATTACHMENTS_DIR="+attachmentsTarget)
+		}
+		envs = append(envs, ServiceEnv(workflow.Services)...)
+
+		if wc == nil {
+			spec.Name = "soj-judge-" + ctx.ID + "-" + strconv.Itoa(idx+1)
+			spec.Env = envs
+			spec.Mounts = append(JobMounts(submits_dir, workflow_dir), spec.Mounts...)
+
+			var ok bool
+			ok, cid = RunImage(wf_tctx, spec)
+
+			if !ok {
+				EndSpan(wf_span, errors.New("failed to run judge container"))
+				ctx.WorkflowResults = append(ctx.WorkflowResults, wr)
+				ctx.SetStatus("failed").SetMsg("failed to run judge container").Update()
+				return
+			}
+
+			defer CleanContainer(cid)
+		}
 
 		steps := make([]WorkflowStepResult, len(workflow.Steps))
 
@@ -342,13 +496,21 @@ workdir_created:
 				re = ColoredIO{ctx.Userface, aurora.RedFg}
 
 			}
-			ec, logs, err := ExecContainer(cid, step, workflow.Timeout, rr, re, envs, priv)
+			step_start := time.Now()
+			ec, logs, err := ExecContainer(wf_tctx, cid, step, workflow.Timeout, rr, re, envs, priv)
+			metricStepDuration.WithLabelValues(ctx.Problem, strconv.Itoa(idx+1), strconv.Itoa(sidx+1)).Observe(time.Since(step_start).Seconds())
 
 			if ok {
 				ctx.Userface.Println(aurora.Gray(15, "exit code:"), aurora.Yellow(ec))
 			}
 
 			if ec != 0 || err != nil {
+				if err == nil {
+					err = errors.New("step exited with code " + strconv.Itoa(ec))
+				}
+				EndSpan(wf_span, err)
+				wr.Steps = steps[:sidx]
+				ctx.WorkflowResults = append(ctx.WorkflowResults, wr)
 				ctx.SetStatus("failed").SetMsg("failed to run judge " + strconv.Itoa(idx+1) + " step " + strconv.Itoa(sidx+1)).Update()
 
 				log.Info().Timestamp().Str("id", ctx.ID).Str("image", workflow.Image).Str("step", step).Int("timeout", workflow.Timeout).AnErr("err", err).Str("logs", logs).Int("exitcode", ec).Msg("failed to run judge step")
@@ -356,7 +518,7 @@ workdir_created:
 			}
 
 			steps[sidx] = WorkflowStepResult{
-				Logs:     logs,
+				LogID:    SaveLog(ctx.ID+"-wf"+strconv.Itoa(idx+1)+"-s"+strconv.Itoa(sidx+1), logs),
 				ExitCode: ec,
 			}
 
@@ -364,24 +526,44 @@ workdir_created:
 			log.Debug().Timestamp().Str("id", ctx.ID).Str("image", workflow.Image).Str("step", step).Int("timeout", workflow.Timeout).Str("logs", logs).Int("exitcode", ec).Msg("ran judge step")
 		}
 
-		logs, err := GetContainerLogs(cid)
+		logs, err := GetContainerLogs(wf_tctx, cid)
+		wr.Steps = steps
+
+		services.Stop()
+
 		if err != nil {
+			EndSpan(wf_span, err)
+			ctx.WorkflowResults = append(ctx.WorkflowResults, wr)
 			ctx.SetStatus("failed").SetMsg("failed to get judge logs").Update()
 			return
 		}
 
-		ctx.WorkflowResults = append(ctx.WorkflowResults, WorkflowResult{
-			Success: true,
-			Logs:    logs,
-			Steps:   steps,
-		})
+		if wc != nil {
+			err = wc.Detach()
+			if err != nil {
+				EndSpan(wf_span, err)
+				ctx.WorkflowResults = append(ctx.WorkflowResults, wr)
+				ctx.SetStatus("failed").SetMsg("failed to collect judge files").Update()
+				return
+			}
+		}
+
+		wr.Success = true
+		wr.LogID = SaveLog(ctx.ID+"-wf"+strconv.Itoa(idx+1), logs)
+		ctx.WorkflowResults = append(ctx.WorkflowResults, wr)
+
+		metricWorkflowDuration.WithLabelValues(ctx.Problem, strconv.Itoa(idx+1)).Observe(time.Since(workflow_start).Seconds())
+		wf_span.End()
 
-		log.Debug().Timestamp().Any("mnt", _mount).Str("id", ctx.ID).Str("image", workflow.Image).Str("logs", logs).Msg("got judge logs")
+		log.Debug().Timestamp().Str("id", ctx.ID).Str("container", cid).Str("image", workflow.Image).Int("logsize", len(logs)).Msg("got judge logs")
 
 	}
 
 	ctx.SetStatus("collect_result").Update()
 
+	_, collect_span := tracer.Start(tctx, "collect_result")
+	defer collect_span.End()
+
 	var result_file = workflow_dir + "/result.json"
 
 	_result, err := os.ReadFile(result_file)
@@ -402,6 +584,39 @@ workdir_created:
 	ctx.SetStatus("completed").SetMsg("judge successfully finished").Update()
 }
 
+// JudgeSpec is the container spec of a workflow before its image is pinned,
+// its security profile applied and the submission mounted.
+func JudgeSpec(workflow Workflow) ContainerSpec {
+	var usr = strconv.Itoa(cfg.SubmitUid)
+
+	if workflow.Root {
+		usr = "0"
+	}
+
+	var mounts []mount.Mount
+	for _, mnt := range workflow.Mounts {
+		mounts = append(mounts, mount.Mount{
+			Type:     mount.Type(mnt.Type),
+			Source:   mnt.Source,
+			Target:   mnt.Target,
+			ReadOnly: mnt.ReadOnly,
+		})
+	}
+
+	return ContainerSpec{
+		User:     usr,
+		Hostname: "soj-judgement",
+		Image:    workflow.Image,
+		WorkDir:  "/work",
+		Mounts:   mounts,
+
+		NetworkDisabled: workflow.DisableNetwork,
+		NetworkHost:     workflow.NetworkHostMode,
+
+		StopTimeout: workflow.Timeout,
+	}
+}
+
 // CopyFile copies a single file from src to dst and returns the MD5 hash of the copied file.
 func CopyFile(src, dst string) (string, error) {
 	sourceFile, err := os.Open(src)
@@ -431,7 +646,10 @@ func CopyFile(src, dst string) (string, error) {
 }
 
 // SubmitFile adds a file to the problem's submition list.
-func SubmitFile(ctx *SubmitCtx, submits_dir string, submit_path string) error {
+func SubmitFile(tctx context.Context, ctx *SubmitCtx, submits_dir string, submit_path string) (err error) {
+	_, span := tracer.Start(tctx, "SubmitFile", trace.WithAttributes(attribute.String("soj.submit.file", submit_path)))
+	defer func() { EndSpan(span, err) }()
+
 	var src_submit_path = path.Join(ctx.SubmitDir, submit_path)
 	var dst_submit_path = path.Join(submits_dir, submit_path)
 
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	ssh "github.com/gliderlabs/ssh"
+)
+
+// setupTestEnv points SOJ at temporary directories, a fresh sqlite
+// database and a FakeRuntime, and restores the globals afterwards.
+func setupTestEnv(t *testing.T) *FakeRuntime {
+	t.Helper()
+
+	oldCfg, oldDB, oldRuntime, oldStore := cfg, db, container_runtime, logstore
+	t.Cleanup(func() {
+		cfg, db, container_runtime, logstore = oldCfg, oldDB, oldRuntime, oldStore
+	})
+
+	dir := t.TempDir()
+	cfg = Config{
+		SubmitsDir:        path.Join(dir, "submits"),
+		SubmitWorkDir:     path.Join(dir, "workdirs"),
+		RealSubmitWorkDir: path.Join(dir, "workdirs"),
+		ProblemsDir:       path.Join(dir, "problems"),
+		SqlitePath:        path.Join(dir, "soj.db"),
+		SubmitUid:         os.Getuid(),
+		SubmitGid:         os.Getgid(),
+		SnapshotKeep:      -1,
+	}
+	for _, d := range []string{cfg.SubmitsDir, cfg.SubmitWorkDir, cfg.ProblemsDir} {
+		if err := os.MkdirAll(d, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var err error
+	db, err = OpenDB("sqlite", cfg.SqlitePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := MigrateTo(LatestSchemaVersion()); err != nil {
+		t.Fatal(err)
+	}
+	InitLogStore()
+
+	fake := NewFakeRuntime()
+	container_runtime = fake
+	return fake
+}
+
+// testSession is the ssh session of user with stdin read from In and
+// stdout and stderr written to Out and Err. Other methods are not implemented.
+type testSession struct {
+	ssh.Session
+	user string
+	cmd  []string
+	In   io.Reader
+	Out  bytes.Buffer
+	Err  bytes.Buffer
+	Code int // passed to Exit
+}
+
+func (s *testSession) User() string                { return s.user }
+func (s *testSession) Read(p []byte) (int, error)  { return s.In.Read(p) }
+func (s *testSession) Write(p []byte) (int, error) { return s.Out.Write(p) }
+func (s *testSession) Stderr() io.ReadWriter       { return &s.Err }
+func (s *testSession) Command() []string           { return s.cmd }
+func (s *testSession) Exit(code int) error         { s.Code = code; return nil }
+
+// writeResult makes the exec write the judge result to /work/result.json.
+func writeResult(c *FakeContainer, result string) int {
+	if err := os.WriteFile(c.HostPath("/work/result.json"), []byte(result), 0600); err != nil {
+		return 1
+	}
+	return 0
+}
+
+func TestRunJudge(t *testing.T) {
+	tests := []struct {
+		name    string
+		steps   []string
+		timeout int
+		fail    map[string]error
+		onExec  func(c *FakeContainer, spec ExecSpec, stdout, stderr io.Writer) int
+
+		status  string
+		msg     string
+		score   float64
+		results int // steps with a result
+	}{
+		{
+			name:    "success",
+			steps:   []string{"make", "judge"},
+			timeout: 10,
+			onExec: func(c *FakeContainer, spec ExecSpec, stdout, stderr io.Writer) int {
+				io.WriteString(stdout, "ran "+spec.Cmd[2]+"\n")
+				if spec.Cmd[2] == "judge" {
+					return writeResult(c, `{"Success": true, "Score": 87.5, "Msg": "ok"}`)
+				}
+				return 0
+			},
+			status:  "completed",
+			msg:     "judge successfully finished",
+			score:   87.5,
+			results: 2,
+		},
+		{
+			name:    "failing step",
+			steps:   []string{"make", "judge"},
+			timeout: 10,
+			onExec: func(c *FakeContainer, spec ExecSpec, stdout, stderr io.Writer) int {
+				if spec.Cmd[2] == "judge" {
+					io.WriteString(stderr, "segfault\n")
+					return 139
+				}
+				return 0
+			},
+			status:  "failed",
+			msg:     "failed to run judge 1 step 2",
+			results: 1,
+		},
+		{
+			name:    "no result",
+			steps:   []string{"make"},
+			timeout: 10,
+			status:  "failed",
+			msg:     "failed to read result file",
+			results: 1,
+		},
+		{
+			name:    "timeout",
+			steps:   []string{"sleep 60"},
+			timeout: 1,
+			onExec: func(c *FakeContainer, spec ExecSpec, stdout, stderr io.Writer) int {
+				time.Sleep(1500 * time.Millisecond)
+				return 0
+			},
+			status: "failed",
+			msg:    "failed to run judge 1 step 1",
+		},
+		{
+			name:    "container create error",
+			steps:   []string{"make"},
+			timeout: 10,
+			fail:    map[string]error{"create": errors.New("no space left on device")},
+			status:  "failed",
+			msg:     "failed to run judge container",
+		},
+		{
+			name:    "exec error",
+			steps:   []string{"make"},
+			timeout: 10,
+			fail:    map[string]error{"exec": errors.New("connection reset")},
+			status:  "failed",
+			msg:     "failed to run judge 1 step 1",
+		},
+		{
+			name:    "missing image",
+			steps:   []string{"make"},
+			timeout: 10,
+			fail:    map[string]error{"image_inspect": errors.New("no such image")},
+			status:  "failed",
+			msg:     `judge image "alpine" is not available`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := setupTestEnv(t)
+			fake.OnExec = tt.onExec
+			for op, err := range tt.fail {
+				fake.Fail[op] = err
+			}
+
+			pb := Problem{
+				Id:      "a-plus-b",
+				Weight:  1,
+				Submits: []Submit{{Path: "main.c"}},
+				Workflow: []Workflow{{
+					Image:   "alpine",
+					Steps:   tt.steps,
+					Timeout: tt.timeout,
+					Show:    []int{1},
+				}},
+			}
+			src := path.Join(cfg.SubmitsDir, "alice", pb.Id)
+			os.MkdirAll(src, 0700)
+			os.WriteFile(path.Join(src, "main.c"), []byte("int main() {}\n"), 0600)
+
+			var out strings.Builder
+			ctx := NewSubmitCtx(context.Background(), "alice", &pb, &out)
+			RunJudge(ctx)
+
+			select {
+			case <-ctx.running:
+			default:
+				t.Error("running not closed")
+			}
+			if ctx.Status != tt.status || ctx.Msg != tt.msg {
+				t.Errorf("got %s %q, want %s %q", ctx.Status, ctx.Msg, tt.status, tt.msg)
+			}
+			if ctx.JudgeResult.Score != tt.score {
+				t.Errorf("got score %v, want %v", ctx.JudgeResult.Score, tt.score)
+			}
+			var steps int
+			for _, wr := range ctx.WorkflowResults {
+				steps += len(wr.Steps)
+			}
+			if steps != tt.results {
+				t.Errorf("got %d step results, want %d", steps, tt.results)
+			}
+			if len(ctx.SubmitsHashes) != 1 {
+				t.Errorf("got %d submitted files, want 1", len(ctx.SubmitsHashes))
+			}
+
+			// the judge container is gone and the submission is stored
+			if cs, _ := fake.List(context.Background(), "soj-judge-"); len(cs) != 0 {
+				t.Errorf("%d judge containers left", len(cs))
+			}
+			var stored SubmitCtx
+			if err := db.First(&stored, "id = ?", ctx.ID).Error; err != nil {
+				t.Fatal(err)
+			}
+			if stored.Status != tt.status || stored.LogID == "" {
+				t.Errorf("stored %s with log %q", stored.Status, stored.LogID)
+			}
+			if !strings.Contains(LoadLog(stored.LogID), "Submission "+ColorizeStatus(tt.status).String()) {
+				t.Errorf("judge output lacks the final status:\n%s", LoadLog(stored.LogID))
+			}
+		})
+	}
+}
+
+func TestRunJudgeShowsSteps(t *testing.T) {
+	fake := setupTestEnv(t)
+	fake.OnExec = func(c *FakeContainer, spec ExecSpec, stdout, stderr io.Writer) int {
+		io.WriteString(stdout, "output of "+spec.Cmd[2]+"\n")
+		return writeResult(c, `{"Success": true, "Score": 100}`)
+	}
+
+	pb := Problem{
+		Id:       "hidden",
+		Weight:   1,
+		Submits:  []Submit{{Path: "src", IsDir: true}},
+		Workflow: []Workflow{{Image: "alpine", Steps: []string{"shown", "hidden"}, Timeout: 10, Show: []int{1}}},
+	}
+	src := path.Join(cfg.SubmitsDir, "bob", pb.Id, "src", "sub")
+	os.MkdirAll(src, 0700)
+	os.WriteFile(path.Join(src, "a.c"), []byte("a"), 0600)
+
+	var out strings.Builder
+	ctx := NewSubmitCtx(context.Background(), "bob", &pb, &out)
+	RunJudge(ctx)
+
+	if ctx.Status != "completed" {
+		t.Fatalf("got %s %q", ctx.Status, ctx.Msg)
+	}
+	if !strings.Contains(out.String(), "output of shown") || strings.Contains(out.String(), "output of hidden") {
+		t.Errorf("only step 1 should be shown:\n%s", out.String())
+	}
+	if len(ctx.SubmitsHashes) != 1 || ctx.SubmitsHashes[0].Path != "src/sub/a.c" {
+		t.Errorf("got submitted files %+v", ctx.SubmitsHashes)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path"
+	"strconv"
+
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+// LogStore keeps judge logs outside of the submissions table.
+// Logs are gzip compressed and addressed by an ID derived from the submit ID.
+type LogStore interface {
+	Put(id string, data []byte) error
+	Get(id string) ([]byte, error)
+}
+
+var logstore LogStore
+
+const defaultLogMaxBytes = 1 << 20
+
+// JudgeLog is a log blob in the database log store.
+type JudgeLog struct {
+	ID   string `gorm:"primaryKey"`
+	Size int
+	Data []byte
+}
+
+type dbLogStore struct {
+	tx *gorm.DB // nil for the global db
+}
+
+func (s dbLogStore) conn() *gorm.DB {
+	if s.tx != nil {
+		return s.tx
+	}
+	return db
+}
+
+func (s dbLogStore) Put(id string, data []byte) error {
+	z, err := compress(data)
+	if err != nil {
+		return err
+	}
+	return s.conn().Save(&JudgeLog{ID: id, Size: len(data), Data: z}).Error
+}
+
+func (s dbLogStore) Get(id string) ([]byte, error) {
+	var l JudgeLog
+	err := s.conn().Where("id = ?", id).First(&l).Error
+	if err != nil {
+		return nil, err
+	}
+	return decompress(l.Data)
+}
+
+type fileLogStore struct {
+	dir string
+}
+
+func (s fileLogStore) Put(id string, data []byte) error {
+	z, err := compress(data)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path.Join(s.dir, id+".gz"), z, 0600)
+}
+
+func (s fileLogStore) Get(id string) ([]byte, error) {
+	z, err := os.ReadFile(path.Join(s.dir, id+".gz"))
+	if err != nil {
+		return nil, err
+	}
+	return decompress(z)
+}
+
+// InitLogStore sets up the log store selected by cfg.
+func InitLogStore() {
+	if cfg.LogMaxBytes == 0 {
+		cfg.LogMaxBytes = defaultLogMaxBytes
+	}
+
+	store := cfg.LogStore
+	if store == "" {
+		store = "db"
+		if cfg.LogDir != "" {
+			store = "file"
+		}
+	}
+
+	switch store {
+	case "file":
+		err := os.MkdirAll(cfg.LogDir, 0700)
+		if err != nil {
+			log.Fatal().Err(err).Str("dir", cfg.LogDir).Msg("failed to create log dir")
+		}
+		logstore = fileLogStore{dir: cfg.LogDir}
+	case "db":
+		logstore = dbLogStore{}
+	default:
+		log.Fatal().Str("store", store).Msg("unknown log store")
+	}
+
+	log.Info().Str("store", store).Int("max_bytes", cfg.LogMaxBytes).Msg("log store ready")
+}
+
+// LogStoreTx returns the log store bound to the transaction tx,
+// for use in migrations that hold a write lock on the database.
+func LogStoreTx(tx *gorm.DB) LogStore {
+	if _, ok := logstore.(dbLogStore); ok {
+		return dbLogStore{tx: tx}
+	}
+	return logstore
+}
+
+// SaveLog truncates data to the configured cap and writes it to the log store.
+func SaveLog(id string, data string) string {
+	return saveLogTo(logstore, id, data)
+}
+
+// LoadLog reads a log from the log store. Missing logs read as a marker.
+func LoadLog(id string) string {
+	return loadLogFrom(logstore, id)
+}
+
+func saveLogTo(store LogStore, id string, data string) string {
+	err := store.Put(id, TruncateLog([]byte(data), cfg.LogMaxBytes))
+	if err != nil {
+		log.Err(err).Str("log", id).Msg("failed to save log")
+		return ""
+	}
+	return id
+}
+
+func loadLogFrom(store LogStore, id string) string {
+	if id == "" {
+		return ""
+	}
+	b, err := store.Get(id)
+	if err != nil {
+		log.Err(err).Str("log", id).Msg("failed to load log")
+		return "[log " + id + " unavailable]\n"
+	}
+	return string(b)
+}
+
+// TruncateLog keeps the head and the tail of b if it is longer than max bytes,
+// with a marker telling how much was dropped in between.
+func TruncateLog(b []byte, max int) []byte {
+	if max <= 0 || len(b) <= max {
+		return b
+	}
+	half := max / 2
+	marker := "\n... [truncated " + strconv.Itoa(len(b)-2*half) + " bytes] ...\n"
+
+	var out = make([]byte, 0, 2*half+len(marker))
+	out = append(out, b[:half]...)
+	out = append(out, marker...)
+	out = append(out, b[len(b)-half:]...)
+	return out
+}
+
+func compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decompress(z []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(z))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
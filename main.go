@@ -2,23 +2,24 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"os"
-	"path"
+	"os/signal"
 	"sort"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
-	"gorm.io/driver/sqlite"
-	"gorm.io/gorm"
-
 	"github.com/logrusorgru/aurora/v4"
 	"github.com/rs/zerolog/log"
 
-	"github.com/docker/docker/client"
 	ssh "github.com/gliderlabs/ssh"
 	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	gossh "golang.org/x/crypto/ssh"
 	"gopkg.in/yaml.v3"
 )
@@ -28,6 +29,8 @@ type Config struct {
 	ListenAddr string `yaml:"ListenAddr"`
 	APIAddr    string `yaml:"APIAddr"`
 
+	MetricsAddr string `yaml:"MetricsAddr"` // Prometheus /metrics listener, e.g. 127.0.0.1:9100, apart from the public API; off when empty
+
 	AllowedSSHPubkey string `yaml:"AllowedSSHPubkey"`
 
 	SubmitsDir    string `yaml:"SubmitsDir"`
@@ -38,20 +41,66 @@ type Config struct {
 	RealSubmitWorkDir string `yaml:"RealSubmitWorkDir"`
 
 	SqlitePath string `yaml:"SqlitePath"`
+	DBDriver   string `yaml:"DBDriver"` // sqlite (default), postgres or mysql
+	DBDSN      string `yaml:"DBDSN"`    // defaults to SqlitePath for sqlite
 
-	DockerCli        string `yaml:"DockerCli"`
+	DockerCli        string `yaml:"DockerCli"`   // container runtime: docker (default), podman or fake
+	RuntimeHost      string `yaml:"RuntimeHost"` // podman API socket, e.g. unix:///run/user/1000/podman/podman.sock
 	ProblemURLPrefix string `yaml:"ProblemURLPrefix"`
 
 	SubmitGid int `yaml:"SubmitGid"`
 	SubmitUid int `yaml:"SubmitUid"`
 
 	Admins []string `yaml:"Admins"`
+
+	TraceEndpoint string `yaml:"TraceEndpoint"`
+	TraceInsecure bool   `yaml:"TraceInsecure"`
+	TraceFile     string `yaml:"TraceFile"`
+
+	LogStore    string `yaml:"LogStore"` // file or db, defaults to file when LogDir is set
+	LogDir      string `yaml:"LogDir"`
+	LogMaxBytes int    `yaml:"LogMaxBytes"` // per log, longer logs are truncated in the middle
+
+	WarmPool map[string]int `yaml:"WarmPool"` // judge image -> number of containers started ahead of time, for workflows on the bridge network
+
+	MountAllowlist []string `yaml:"MountAllowlist"` // host directories bind mounts of problems may come from, besides ProblemsDir
+
+	ProblemWatchDelay int `yaml:"ProblemWatchDelay"` // milliseconds ProblemsDir has to be quiet before a reload, defaults to 1000, negative disables watching
+
+	JudgeNetwork string `yaml:"JudgeNetwork"` // network of workflows without one: isolated (default), one internal network per submission, or bridge
+
+	SftpMode string `yaml:"SftpMode"` // builtin (default) or container, without problem attachments
+
+	// per user workspace limits, 0 is unlimited; only the builtin SFTP server and scp enforce them
+	QuotaBytes  int64 `yaml:"QuotaBytes"`
+	QuotaInodes int64 `yaml:"QuotaInodes"`
+
+	// workspace snapshots, kept outside SubmitsDir; defaults to "snapshots" next to it
+	SnapshotDir      string `yaml:"SnapshotDir"`
+	SnapshotInterval int    `yaml:"SnapshotInterval"` // minutes between periodic snapshots, defaults to 60, negative disables
+	SnapshotKeep     int    `yaml:"SnapshotKeep"`     // snapshots kept per user and problem, defaults to 20, negative keeps all
+
+	ArchiveMaxBytes int64 `yaml:"ArchiveMaxBytes"` // limit of archives piped into 'submit --stdin' and of packs pushed by git, defaults to 64 MiB
+
+	GCInterval       int `yaml:"GCInterval"`       // minutes between garbage collections, defaults to 10, negative disables
+	WorkdirRetention int `yaml:"WorkdirRetention"` // days to keep submission workdirs, 0 keeps them forever
 }
 
 var cfg = Config{}
 
+// DSN returns the data source name of the configured database.
+func (c Config) DSN() string {
+	if c.DBDSN == "" && (c.DBDriver == "" || c.DBDriver == "sqlite") {
+		return c.SqlitePath
+	}
+	return c.DBDSN
+}
+
 var paused = false
 
+// shutdownTimeout is how long open ssh sessions may take to end on SIGINT or SIGTERM.
+const shutdownTimeout = 10 * time.Second
+
 func main() {
 
 	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
@@ -66,6 +115,16 @@ func main() {
 		log.Fatal().Err(err).Msg("failed to parse config file")
 	}
 
+	switch cfg.JudgeNetwork {
+	case "", "isolated", "bridge":
+	default:
+		log.Fatal().Str("network", cfg.JudgeNetwork).Msg("unknown judge network")
+	}
+
+	if len(os.Args) > 1 {
+		os.Exit(RunCLI(os.Args[1:]))
+	}
+
 	var pubkey gossh.PublicKey
 	if cfg.AllowedSSHPubkey != "" {
 		pubkey, _, _, _, err = gossh.ParseAuthorizedKey([]byte(cfg.AllowedSSHPubkey))
@@ -76,372 +135,692 @@ func main() {
 		log.Warn().Msg("no allowed ssh pubkey specified, allowing all")
 	}
 
-	docker_cli, err = client.NewClientWithOpts(client.FromEnv)
+	// log.Fatal skips deferred calls, so it is called by hand
+	shutdownTracing := InitTracing()
+
+	container_runtime, err = NewRuntime(cfg.DockerCli)
 	if err != nil {
-		log.Fatal().Err(err).Msg("failed to create docker client")
+		log.Fatal().Err(err).Str("runtime", cfg.DockerCli).Msg("failed to create container runtime")
 	}
+	AdaptSubmitIds()
 
 	pk, err := gossh.ParsePrivateKey([]byte(cfg.HostKey))
 	if err != nil {
 		log.Fatal().Err(err).Msg("failed to parse host key")
 	}
 
-	db, err = gorm.Open(sqlite.Open(cfg.SqlitePath), &gorm.Config{})
+	db, err = OpenDB(cfg.DBDriver, cfg.DSN())
 	if err != nil {
-		log.Fatal().Err(err).Msg("failed to open sqlite")
+		log.Fatal().Err(err).Str("driver", cfg.DBDriver).Msg("failed to open database")
 	}
 
-	db.AutoMigrate(&SubmitCtx{})
-	db.AutoMigrate(&User{})
+	InitLogStore()
+
+	CheckSchema()
 
 	db.Model(&SubmitCtx{}).Where("status != ? AND status != ? AND status != ?", "completed", "dead", "failed").Update("status", "dead")
 
-	problems := LoadProblemDir(cfg.ProblemsDir)
+	problems, perrs := LoadProblemDir(cfg.ProblemsDir)
+	if perrs != nil {
+		for _, e := range perrs {
+			log.Error().Str("file", e.File).Str("problem", e.Problem).Str("field", e.Field).Msg(e.Msg)
+		}
+		log.Fatal().Int("errors", len(perrs)).Str("dir", cfg.ProblemsDir).Msg("invalid problems")
+	}
+
+	SetProblems(problems)
 
 	DoFULLUserScan(problems)
 
+	WarmUp(problems)
+
+	go RunGCLoop()
+	go RunSnapshotLoop()
+	go WatchProblemDir()
+
 	serveHTTP(cfg.APIAddr)
+	serveMetrics(cfg.MetricsAddr)
 
 	s := &ssh.Server{
 		Addr: cfg.ListenAddr,
 		Handler: func(s ssh.Session) {
+			format, cmds := ParseOutputFlags(s.Command())
+
+			var w io.Writer = s
+			if _, _, pty := s.Pty(); !pty {
+				w = noColorWriter{s}
+			}
+			out := &Output{Format: format, W: w}
+
 			uf := Userface{
 				Buffer: bytes.NewBuffer(nil),
-				Writer: s,
+				Writer: w,
+			}
+			if out.Structured() {
+				// stdout is for the results
+				uf.Writer = noColorWriter{s.Stderr()}
 			}
-
-			cmds := s.Command()
 			log.Info().Str("user", s.User()).Strs("cmds", cmds).Msg("new session")
+			metricSSHSessions.WithLabelValues(sshCommandLabel(cmds)).Inc()
+
+			// not derived from s.Context(): the judge must outlive a dropped connection
+			tctx, span := tracer.Start(context.Background(), "ssh.session", trace.WithAttributes(
+				attribute.String("ssh.user", s.User()),
+				attribute.String("ssh.command", sshCommandLabel(cmds)),
+			))
+			defer span.End()
+
+			if len(cmds) > 0 && cmds[0] == "git-receive-pack" {
+				GitReceivePack(s, tctx)
+				return
+			}
+			if len(cmds) > 0 && cmds[0] == "scp" {
+				ScpHandler(s)
+				return
+			}
 
 			if len(cmds) == 0 {
-				uf.Println("Welcome to", aurora.Bold("SOJ"), aurora.Gray(aurora.GrayIndex(10), "Secure Online Judge"), ",", aurora.BrightBlue(s.User()))
-				uf.Println(aurora.Yellow(time.Now().Format(time.DateTime + " MST")))
-				uf.Println("Use 'submit", aurora.Gray(15, "(sub)"), "<problem_id>' to submit a problem")
-				uf.Println("Use 'list", aurora.Gray(15, "(ls)"), "[page]' to list your submissions")
-				uf.Println("Use 'status", aurora.Gray(15, "(st)"), "<submit_id>' to show a submission", aurora.Magenta("(fuzzy match)"))
-				uf.Println("Use 'rank", aurora.Gray(15, "(rk)"), "' to show ranklist")
-				uf.Println("Use 'my' to show your submission summary")
-				// uf.Println("Use 'problems' to list problems")
+				if _, _, pty := s.Pty(); pty && !out.Structured() {
+					RunShell(s, tctx)
+					return
+				}
+				PrintWelcome(uf, s.User())
+				PrintHelp(uf)
+				uf.Println("Connect from a terminal without a command for an interactive shell")
 				uf.Println()
-
 			} else {
 				uf.Println(aurora.Yellow(time.Now().Format(time.DateTime + " MST")))
+				RunCommand(s, tctx, uf, out, cmds)
+			}
 
-				switch cmds[0] {
-				// case "problems":
-				// 	uf.Println("Problems:", aurora.Italic(aurora.Gray(15, "(click to show in browser)")))
-				// 	for k := range problems {
-				// 		url := cfg.ProblemURLPrefix + k
-				// 		uf.Println("	", aurora.Bold(k), aurora.Hyperlink(url, url))
-				// 	}
-				case "rank", "rk":
-					usrs := make([]User, 0)
-
-					var prblmss []string
-					for k := range problems {
-						prblmss = append(prblmss, k)
-					}
+		},
+		SubsystemHandlers: map[string]ssh.SubsystemHandler{
+			"sftp": SftpHandler,
+		},
+		PublicKeyHandler: func(ctx ssh.Context, key ssh.PublicKey) bool {
+			return pubkey == nil || ssh.KeysEqual(pubkey, key)
+		},
+	}
+	s.AddHostKey(pk)
 
-					sort.Strings(prblmss)
+	stopped := make(chan struct{})
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		sig := <-sigs
+		log.Info().Str("signal", sig.String()).Msg("shutting down")
+
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := s.Shutdown(ctx); err != nil {
+			log.Err(err).Msg("closing remaining ssh sessions")
+			s.Close()
+		}
+		close(stopped)
+	}()
 
-					db.Order("total_score desc").Find(&usrs)
+	log.Info().Str("addr", cfg.ListenAddr).Msg("listening")
+	err = s.ListenAndServe()
+	if err != ssh.ErrServerClosed {
+		shutdownTracing()
+		log.Fatal().Err(err).Msg("failed to listen")
+	}
+	<-stopped
+	shutdownTracing()
+}
 
-					var ranks []string
+// PrintWelcome greets user.
+func PrintWelcome(uf Userface, user string) {
+	uf.Println("Welcome to", aurora.Bold("SOJ"), aurora.Gray(aurora.GrayIndex(10), "Secure Online Judge"), ",", aurora.BrightBlue(user))
+	uf.Println(aurora.Yellow(time.Now().Format(time.DateTime + " MST")))
+	// admins learn about a broken problem change they missed
+	if res := LastReload(); IsAdmin(user) && res.Errs != nil {
+		ShowReload(uf, res)
+	}
+}
 
-					var cursoc float64 = -1
-					var currk int = 0
-					for i := range usrs {
-						if usrs[i].TotalScore != cursoc {
-							currk = i
-							cursoc = usrs[i].TotalScore
-						}
-						ranks = append(ranks, strconv.Itoa(currk+1))
+// PrintHelp lists the commands.
+func PrintHelp(uf Userface) {
+	uf.Println("Use 'problems' to list problems and 'problem <problem_id>' to show one")
+	uf.Println("Use 'submit", aurora.Gray(15, "(sub)"), "<problem_id> [--stdin]' to submit a problem", aurora.Gray(15, "(--stdin reads a tar or zip archive)"))
+	uf.Println("Use 'list", aurora.Gray(15, "(ls)"), "[page]' to list your submissions")
+	uf.Println("Use 'status", aurora.Gray(15, "(st)"), "<submit_id>' to show a submission", aurora.Magenta("(fuzzy match)"))
+	uf.Println("Use 'rank", aurora.Gray(15, "(rk)"), "' to show ranklist")
+	uf.Println("Use 'my' to show your submission summary")
+	uf.Println("Add '--json' or '--csv' to a command for output for scripts")
+	uf.Println("Use 'git push ssh://<host>/<problem_id>' to submit from git")
+	uf.Println("Use 'snap <problem_id> [diff|restore <snapshot>]' to manage snapshots of your files")
+}
 
-					}
+// RunCommand runs a command of exec mode or of the interactive shell.
+func RunCommand(s ssh.Session, tctx context.Context, uf Userface, out *Output, cmds []string) {
+	problems := CurrentProblems()
 
-					var userss []string
-					for _, u := range usrs {
-						userss = append(userss, u.ID)
-					}
+	switch cmds[0] {
+	case "problems":
+		uf.Println(aurora.Green("Listing"), aurora.Bold("problems"))
 
-					var totalscores []string
-					for _, u := range usrs {
-						totalscores = append(totalscores, fmt.Sprintf("%.2f", u.TotalScore))
-					}
+		var user User
+		db.Where("ID = ?", s.User()).Find(&user)
+		counts := ProblemSubmitCounts()
 
-					var bestscores [][]string
+		if out.Structured() {
+			out.Problems(problems, user, counts)
+			return
+		}
+		ListProblems(uf, problems, user, counts)
 
-					for _, p := range prblmss {
-						var scores []string
-						for _, u := range usrs {
-							scores = append(scores, fmt.Sprintf("%.2f", u.BestScores[p]))
-						}
-						bestscores = append(bestscores, scores)
-					}
+	case "problem":
+		if len(cmds) != 2 {
+			uf.Println(aurora.Red("error:"), "invalid arguments")
+			uf.Println("usage: problem <problem_id>")
+			return
+		}
 
-					var colc = make([]aurora.Color, len(prblmss))
-					for i := range colc {
-						colc[i] = aurora.WhiteFg | aurora.UnderlineFm
-					}
+		pb, ok := problems[cmds[1]]
+		if !ok {
+			uf.Println(aurora.Red("error:"), "problem", aurora.Yellow(strconv.Quote(cmds[1])), "not found")
+			return
+		}
 
-					MkTable(uf, append([]string{"Rank", "User", "Total"}, prblmss...), append([]aurora.Color{aurora.BoldFm | aurora.YellowFg, aurora.BoldFm | aurora.WhiteFg, aurora.BoldFm | aurora.GreenFg}, colc...), append([][]string{ranks, userss, totalscores}, bestscores...))
+		if out.Structured() {
+			out.Problem(pb)
+			return
+		}
+		ShowProblem(uf, pb)
 
-				case "submit", "sub":
-					if len(cmds) != 2 {
-						uf.Println(aurora.Red("error:"), "invalid arguments")
-						uf.Println("usage: submit <problem_id>")
-						return
-					}
-					if paused {
-						uf.Println(aurora.Red("error:"), "submit is paused. Please try again later")
-						return
-					}
+	case "rank", "rk":
+		usrs := make([]User, 0)
 
-					pid := cmds[1]
+		var prblmss []string
+		for k := range problems {
+			prblmss = append(prblmss, k)
+		}
 
-					pb, ok := problems[pid]
-					if !ok {
-						uf.Println(aurora.Red("error:"), "problem", aurora.Yellow(strconv.Quote(pid)), "not found")
-						return
-					}
+		sort.Strings(prblmss)
 
-					uf.Println(aurora.Green("Submitting"), aurora.Bold(pid))
-					subtime := time.Now()
+		db.Order("total_score desc").Find(&usrs)
 
-					id := strconv.Itoa(int(subtime.UnixNano()))
-					ctx := SubmitCtx{
-						ID:      id,
-						Problem: pid,
-						problem: &pb,
-						User:    s.User(),
+		if out.Structured() {
+			out.Rank(usrs, prblmss)
+			return
+		}
 
-						SubmitTime: subtime.UnixNano(),
+		var ranks []string
 
-						Status: "init",
+		var cursoc float64 = -1
+		var currk int = 0
+		for i := range usrs {
+			if usrs[i].TotalScore != cursoc {
+				currk = i
+				cursoc = usrs[i].TotalScore
+			}
+			ranks = append(ranks, strconv.Itoa(currk+1))
 
-						SubmitDir: path.Join(cfg.SubmitsDir, s.User(), pid),
-						Workdir:   path.Join(cfg.SubmitWorkDir, id),
+		}
 
-						RealWorkdir: path.Join(cfg.RealSubmitWorkDir, id),
+		var userss []string
+		for _, u := range usrs {
+			userss = append(userss, u.ID)
+		}
 
-						Userface: Userface{
-							Buffer: bytes.NewBuffer(nil),
-							Writer: uf,
-						},
-						// JudgeResult: JudgeResult{Score: -1},
-						running: make(chan struct{}),
-					}
+		var totalscores []string
+		for _, u := range usrs {
+			totalscores = append(totalscores, fmt.Sprintf("%.2f", u.TotalScore))
+		}
 
-					go RunJudge(&ctx)
+		var bestscores [][]string
 
-					<-ctx.running
+		for _, p := range prblmss {
+			var scores []string
+			for _, u := range usrs {
+				scores = append(scores, fmt.Sprintf("%.2f", u.BestScores[p]))
+			}
+			bestscores = append(bestscores, scores)
+		}
 
-					uf.Println("Submit", "is", ColorizeStatus(ctx.Status))
-					uf.Println("Message:\n	", aurora.Blue(ctx.Msg))
+		var colc = make([]aurora.Color, len(prblmss))
+		for i := range colc {
+			colc[i] = aurora.WhiteFg | aurora.UnderlineFm
+		}
 
-					WriteResult(uf, ctx)
+		MkTable(uf, append([]string{"Rank", "User", "Total"}, prblmss...), append([]aurora.Color{aurora.BoldFm | aurora.YellowFg, aurora.BoldFm | aurora.WhiteFg, aurora.BoldFm | aurora.GreenFg}, colc...), append([][]string{ranks, userss, totalscores}, bestscores...))
 
-					UserUpdate(s.User(), ctx)
+	case "submit", "sub":
+		stdin := len(cmds) == 3 && cmds[2] == "--stdin"
+		if len(cmds) != 2 && !stdin {
+			uf.Println(aurora.Red("error:"), "invalid arguments")
+			uf.Println("usage: submit <problem_id> [--stdin]")
+			return
+		}
+		if paused {
+			uf.Println(aurora.Red("error:"), "submit is paused. Please try again later")
+			return
+		}
 
-				case "list", "ls":
-					if len(cmds) > 2 {
-						uf.Println(aurora.Red("error:"), "invalid arguments")
-						uf.Println("usage: list [page]")
-						return
-					}
+		pid := cmds[1]
 
-					uf.Println(aurora.Green("Listing"), aurora.Bold("submissions"))
+		pb, ok := problems[pid]
+		if !ok {
+			uf.Println(aurora.Red("error:"), "problem", aurora.Yellow(strconv.Quote(pid)), "not found")
+			return
+		}
 
-					page := 1
+		uf.Println(aurora.Green("Submitting"), aurora.Bold(pid))
 
-					if len(cmds) == 2 {
-						var err error
-						page, err = strconv.Atoi(cmds[1])
-						if err != nil {
-							uf.Println(aurora.Red("error:"), "invalid page number")
-							return
-						}
-					}
+		ctx := NewSubmitCtx(tctx, s.User(), &pb, uf)
 
-					var submits []SubmitCtx
-					//paging
-					// reverse order
+		if stdin {
+			// staged next to the workdir, the judge copies the files from there
+			ctx.SubmitDir = ctx.Workdir + ".stdin"
+			defer os.RemoveAll(ctx.SubmitDir)
 
-					// db.Where("user = ?", s.User()).Offset((page - 1) * 10).Limit(10).Find(&submits)
-					db.Where("user = ?", s.User()).Order("submit_time desc").Offset((page - 1) * 10).Limit(10).Find(&submits)
+			uf.Println("Reading archive from stdin")
+			err := StageArchive(s, ctx.SubmitDir, &pb, uf)
+			if err != nil {
+				uf.Println(aurora.Red("error:"), err)
+				return
+			}
+		}
 
-					var total int64
-					db.Model(&SubmitCtx{}).Where("user = ?", s.User()).Count(&total)
+		go RunJudge(ctx)
 
-					uf.Println(aurora.Cyan("Page"), aurora.Bold(page), "of", aurora.Yellow(total/10+1))
+		<-ctx.running
 
-					ListSubs(uf, submits)
+		uf.Println("Submit", "is", ColorizeStatus(ctx.Status))
+		uf.Println("Message:\n	", aurora.Blue(ctx.Msg))
 
-				case "status", "st":
-					if len(cmds) != 2 {
-						uf.Println(aurora.Red("error:"), "invalid arguments")
-						uf.Println("usage: status <submit_id>")
-						return
-					}
+		WriteResult(uf, *ctx)
 
-					uf.Println(aurora.Green("Showing"), aurora.Bold("submission"), aurora.Magenta(cmds[1]))
+		UserUpdate(s.User(), *ctx)
 
-					var submit SubmitCtx
-					tx := db.Order("submit_time desc").Where("id LIKE ? AND user = ?", "%"+cmds[1]+"%", s.User()).First(&submit)
-					if tx.Error != nil {
-						uf.Println(aurora.Red("error:"), "submit", aurora.Yellow(strconv.Quote(cmds[1])), "not found")
-						return
-					}
+		if out.Structured() {
+			out.Submit(*ctx)
+		}
 
-					uf.Println()
+	case "list", "ls":
+		if len(cmds) > 2 {
+			uf.Println(aurora.Red("error:"), "invalid arguments")
+			uf.Println("usage: list [page]")
+			return
+		}
 
-					ShowSub(uf, submit, problems)
+		uf.Println(aurora.Green("Listing"), aurora.Bold("submissions"))
 
-				case "my":
-					uf.Println("User", aurora.Bold(aurora.BrightWhite(s.User())))
+		page := 1
 
-					var user User
+		if len(cmds) == 2 {
+			var err error
+			page, err = strconv.Atoi(cmds[1])
+			if err != nil {
+				uf.Println(aurora.Red("error:"), "invalid page number")
+				return
+			}
+		}
 
-					db.Where("ID = ?", s.User()).Find(&user)
+		var submits []SubmitCtx
+		//paging
+		// reverse order
 
-					if user.ID == "" {
-						uf.Println(aurora.Gray(15, "No submissions yet"))
-						return
-					}
+		// db.Where("user = ?", s.User()).Offset((page - 1) * 10).Limit(10).Find(&submits)
+		db.Select(submitListColumns).Where(ofUser(s.User())).Order("submit_time desc").Offset((page - 1) * 10).Limit(10).Find(&submits)
 
-					var prblmss []string
-					for k := range problems {
-						prblmss = append(prblmss, k)
-					}
+		var total int64
+		db.Model(&SubmitCtx{}).Where(ofUser(s.User())).Count(&total)
 
-					sort.Strings(prblmss)
+		uf.Println(aurora.Cyan("Page"), aurora.Bold(page), "of", aurora.Yellow(total/10+1))
 
-					Cols := []string{"Problem", "Score", "Weight", "Submit ID", "Date"}
-					var ColLongest = make([]int, len(Cols))
-					for i, col := range Cols {
-						ColLongest[i] = len(col)
-					}
+		if out.Structured() {
+			out.Submits(submits)
+			return
+		}
+		ListSubs(uf, submits)
 
-					var map_succ map[string]bool = make(map[string]bool)
-
-					for _, problem_id := range prblmss {
-						sco, ok := user.BestScores[problem_id]
-						if ok {
-							map_succ[problem_id] = true
-						}
-						ColLongest[0] = max(ColLongest[0], len(problem_id))
-						ColLongest[1] = max(ColLongest[1], len(fmt.Sprintf("%.2f", sco/problems[problem_id].Weight)))
-						ColLongest[2] = max(ColLongest[2], len(fmt.Sprintf("%.2f", problems[problem_id].Weight)))
-						ColLongest[3] = max(ColLongest[3], len(user.BestSubmits[problem_id]))
-						ColLongest[4] = max(ColLongest[4], len(time.Unix(0, user.BestSubmitDate[problem_id]).Format(time.DateTime+" MST")))
-					}
+	case "status", "st":
+		if len(cmds) != 2 {
+			uf.Println(aurora.Red("error:"), "invalid arguments")
+			uf.Println("usage: status <submit_id>")
+			return
+		}
 
-					for i, col := range Cols {
-						uf.Printf("%-*s ", ColLongest[i], col)
-					}
+		uf.Println(aurora.Green("Showing"), aurora.Bold("submission"), aurora.Magenta(cmds[1]))
 
-					uf.Println()
-					for _, problem_id := range prblmss {
-						uf.Printf("%-*s %-*.2f %-*.2f %-*s %-*s\n",
-							ColLongest[0], aurora.Bold(aurora.Italic(problem_id)),
-							ColLongest[1], aurora.Bold(ColorizeScore(JudgeResult{Success: map_succ[problem_id], Score: user.BestScores[problem_id] / problems[problem_id].Weight})),
-							ColLongest[2], aurora.Bold(problems[problem_id].Weight),
-							ColLongest[3], aurora.Magenta(user.BestSubmits[problem_id]),
-							ColLongest[4],
-							func() aurora.Value {
-								if map_succ[problem_id] {
-									return aurora.Yellow(time.Unix(0, user.BestSubmitDate[problem_id]).Format(time.DateTime + " MST"))
-								} else {
-									return aurora.Gray(15, "N/A")
-								}
-							}())
-					}
+		var submit SubmitCtx
+		tx := db.Order("submit_time desc").Where("id LIKE ?", "%"+cmds[1]+"%").Where(ofUser(s.User())).First(&submit)
+		if tx.Error != nil {
+			uf.Println(aurora.Red("error:"), "submit", aurora.Yellow(strconv.Quote(cmds[1])), "not found")
+			return
+		}
 
-					uf.Println()
-					uf.Println("Total Score:", aurora.Bold(aurora.BrightWhite(user.TotalScore)))
+		uf.Println()
 
-				case "adm":
-					if !IsAdmin(s.User()) {
-						s.Write([]byte("unknown command " + strconv.Quote(s.RawCommand()) + "\n"))
-						return
-					}
+		if out.Structured() {
+			out.Submit(submit)
+			return
+		}
+		ShowSub(uf, submit, problems)
 
-					if len(cmds) < 2 {
-						uf.Println(aurora.Red("error:"), "invalid arguments")
-						uf.Println("usage: adm <command>")
-						return
-					}
-					switch cmds[1] {
-					case "list":
-						page := 1
-						if len(cmds) == 3 {
-							var err error
-							page, err = strconv.Atoi(cmds[2])
-							if err != nil {
-								uf.Println(aurora.Red("error:"), "invalid page number")
-								return
-							}
-						}
-
-						var submits []SubmitCtx
-						//paging
-						// reverse order
-
-						// db.Where("user = ?", s.User()).Offset((page - 1) * 10).Limit(10).Find(&submits)
-						db.Order("submit_time desc").Offset((page - 1) * 20).Limit(20).Find(&submits)
-
-						var total int64
-						db.Model(&SubmitCtx{}).Count(&total)
-
-						uf.Println(aurora.Cyan("Page"), aurora.Bold(page), "of", aurora.Yellow(total/20+1))
-
-						ListSubs(uf, submits)
-					case "status":
-						if len(cmds) != 3 {
-							uf.Println(aurora.Red("error:"), "invalid arguments")
-							uf.Println("usage: adm status <submit_id>")
-							return
-						}
-
-						uf.Println(aurora.Green("Showing"), aurora.Bold("submission"), aurora.Magenta(cmds[2]))
-
-						var submit SubmitCtx
-						tx := db.Where("id = ?", cmds[2]).First(&submit)
-						if tx.Error != nil {
-							uf.Println(aurora.Red("error:"), "submit", aurora.Yellow(strconv.Quote(cmds[2])), "not found")
-							return
-						}
-
-						uf.Println()
-
-						ShowSub(uf, submit, problems)
-					case "pause":
-						paused = true
-						uf.Println(aurora.Green("Submit"), aurora.Bold("paused"))
-					case "reload":
-						problems = LoadProblemDir(cfg.ProblemsDir)
-						uf.Println(aurora.Green("Problems"), aurora.Bold("reloaded"))
+	case "quota":
+		if out.Structured() {
+			out.Quota(s.User())
+			return
+		}
+		ShowQuota(uf, s.User())
+
+	case "snap":
+		if len(cmds) < 2 || len(cmds) > 5 {
+			uf.Println(aurora.Red("error:"), "invalid arguments")
+			uf.Println("usage: snap <problem_id> [take | diff <snapshot> [file] | restore <snapshot>]")
+			return
+		}
+
+		pid := cmds[1]
+		if _, ok := problems[pid]; !ok {
+			uf.Println(aurora.Red("error:"), "problem", aurora.Yellow(strconv.Quote(pid)), "not found")
+			return
+		}
+
+		if len(cmds) == 2 {
+			snaps, err := ListSnapshots(s.User(), pid)
+			if err != nil {
+				uf.Println(aurora.Red("error:"), err)
+				return
+			}
+			uf.Println(aurora.Green("Listing"), aurora.Bold("snapshots"), "of", aurora.Bold(pid))
+			if out.Structured() {
+				out.Snapshots(snaps)
+				return
+			}
+			ListSnapshotsTable(uf, snaps)
+			return
+		}
+
+		switch cmds[2] {
+		case "take":
+			snap, err := TakeSnapshot(s.User(), pid, "manual", "")
+			if err != nil {
+				uf.Println(aurora.Red("error:"), "failed to take snapshot")
+				return
+			}
+			if snap == nil {
+				uf.Println(aurora.Gray(15, "Nothing changed since the last snapshot"))
+				return
+			}
+			uf.Println(aurora.Green("Snapshot"), aurora.Magenta(snap.ID), "taken")
+		case "diff", "restore":
+			if len(cmds) < 4 || (cmds[2] == "restore" && len(cmds) != 4) {
+				uf.Println(aurora.Red("error:"), "invalid arguments")
+				uf.Println("usage: snap <problem_id> [take | diff <snapshot> [file] | restore <snapshot>]")
+				return
+			}
+			snap, err := FindSnapshot(s.User(), pid, cmds[3])
+			if err != nil {
+				uf.Println(aurora.Red("error:"), "snapshot", aurora.Yellow(strconv.Quote(cmds[3])), "not found")
+				return
+			}
+
+			if cmds[2] == "diff" {
+				var file string
+				if len(cmds) == 5 {
+					file = cmds[4]
+				}
+				uf.Println(aurora.Green("Comparing"), aurora.Bold(pid), "with snapshot", aurora.Magenta(snap.ID))
+				uf.Println()
+				if err := DiffSnapshot(uf, snap, file); err != nil {
+					uf.Println(aurora.Red("error:"), "failed to compare snapshot")
+				}
+				return
+			}
+
+			before, err := RestoreSnapshot(snap)
+			if before != nil {
+				uf.Println("Current files saved as snapshot", aurora.Magenta(before.ID))
+			}
+			if err == errQuota {
+				uf.Println(aurora.Red("error:"), "snapshot does not fit in your quota")
+				return
+			}
+			if err != nil {
+				uf.Println(aurora.Red("error:"), "failed to restore snapshot")
+				return
+			}
+			uf.Println(aurora.Green("Restored"), aurora.Bold(pid), "from snapshot", aurora.Magenta(snap.ID))
+		default:
+			uf.Println(aurora.Red("error:"), "invalid arguments")
+			uf.Println("usage: snap <problem_id> [take | diff <snapshot> [file] | restore <snapshot>]")
+		}
+
+	case "my":
+		uf.Println("User", aurora.Bold(aurora.BrightWhite(s.User())))
+
+		var user User
+
+		db.Where("ID = ?", s.User()).Find(&user)
+
+		if out.Structured() {
+			user.ID = s.User()
+			out.User(user, problems)
+			return
+		}
+
+		if user.ID == "" {
+			uf.Println(aurora.Gray(15, "No submissions yet"))
+			return
+		}
+
+		var prblmss []string
+		for k := range problems {
+			prblmss = append(prblmss, k)
+		}
+
+		sort.Strings(prblmss)
+
+		Cols := []string{"Problem", "Score", "Weight", "Submit ID", "Date"}
+		var ColLongest = make([]int, len(Cols))
+		for i, col := range Cols {
+			ColLongest[i] = len(col)
+		}
+
+		var map_succ map[string]bool = make(map[string]bool)
+
+		for _, problem_id := range prblmss {
+			sco, ok := user.BestScores[problem_id]
+			if ok {
+				map_succ[problem_id] = true
+			}
+			ColLongest[0] = max(ColLongest[0], len(problem_id))
+			ColLongest[1] = max(ColLongest[1], len(fmt.Sprintf("%.2f", sco/problems[problem_id].Weight)))
+			ColLongest[2] = max(ColLongest[2], len(fmt.Sprintf("%.2f", problems[problem_id].Weight)))
+			ColLongest[3] = max(ColLongest[3], len(user.BestSubmits[problem_id]))
+			ColLongest[4] = max(ColLongest[4], len(time.Unix(0, user.BestSubmitDate[problem_id]).Format(time.DateTime+" MST")))
+		}
+
+		for i, col := range Cols {
+			uf.Printf("%-*s ", ColLongest[i], col)
+		}
+
+		uf.Println()
+		for _, problem_id := range prblmss {
+			uf.Printf("%-*s %-*.2f %-*.2f %-*s %-*s\n",
+				ColLongest[0], aurora.Bold(aurora.Italic(problem_id)),
+				ColLongest[1], aurora.Bold(ColorizeScore(JudgeResult{Success: map_succ[problem_id], Score: user.BestScores[problem_id] / problems[problem_id].Weight})),
+				ColLongest[2], aurora.Bold(problems[problem_id].Weight),
+				ColLongest[3], aurora.Magenta(user.BestSubmits[problem_id]),
+				ColLongest[4],
+				func() aurora.Value {
+					if map_succ[problem_id] {
+						return aurora.Yellow(time.Unix(0, user.BestSubmitDate[problem_id]).Format(time.DateTime + " MST"))
+					} else {
+						return aurora.Gray(15, "N/A")
 					}
+				}())
+		}
+
+		uf.Println()
+		uf.Println("Total Score:", aurora.Bold(aurora.BrightWhite(user.TotalScore)))
 
-				default:
-					s.Write([]byte("unknown command " + strconv.Quote(s.RawCommand()) + "\n"))
+	case "adm":
+		if !IsAdmin(s.User()) {
+			uf.Println("unknown command", strconv.Quote(strings.Join(cmds, " ")))
+			return
+		}
+
+		if len(cmds) < 2 {
+			uf.Println(aurora.Red("error:"), "invalid arguments")
+			uf.Println("usage: adm <command>")
+			return
+		}
+		switch cmds[1] {
+		case "list":
+			page := 1
+			if len(cmds) == 3 {
+				var err error
+				page, err = strconv.Atoi(cmds[2])
+				if err != nil {
+					uf.Println(aurora.Red("error:"), "invalid page number")
+					return
 				}
 			}
 
-		},
-		SubsystemHandlers: map[string]ssh.SubsystemHandler{
-			"sftp": SftpHandler,
-		},
-		PublicKeyHandler: func(ctx ssh.Context, key ssh.PublicKey) bool {
-			return pubkey == nil || ssh.KeysEqual(pubkey, key)
-		},
-	}
-	s.AddHostKey(pk)
+			var submits []SubmitCtx
+			//paging
+			// reverse order
 
-	log.Info().Str("addr", cfg.ListenAddr).Msg("listening")
-	err = s.ListenAndServe()
-	if err != nil {
-		log.Fatal().Err(err).Msg("failed to listen")
+			// db.Where("user = ?", s.User()).Offset((page - 1) * 10).Limit(10).Find(&submits)
+			db.Select(submitListColumns).Order("submit_time desc").Offset((page - 1) * 20).Limit(20).Find(&submits)
+
+			var total int64
+			db.Model(&SubmitCtx{}).Count(&total)
+
+			uf.Println(aurora.Cyan("Page"), aurora.Bold(page), "of", aurora.Yellow(total/20+1))
+
+			if out.Structured() {
+				out.Submits(submits)
+				return
+			}
+			ListSubs(uf, submits)
+		case "status":
+			if len(cmds) != 3 {
+				uf.Println(aurora.Red("error:"), "invalid arguments")
+				uf.Println("usage: adm status <submit_id>")
+				return
+			}
+
+			uf.Println(aurora.Green("Showing"), aurora.Bold("submission"), aurora.Magenta(cmds[2]))
+
+			var submit SubmitCtx
+			tx := db.Where("id = ?", cmds[2]).First(&submit)
+			if tx.Error != nil {
+				uf.Println(aurora.Red("error:"), "submit", aurora.Yellow(strconv.Quote(cmds[2])), "not found")
+				return
+			}
+
+			uf.Println()
+
+			if out.Structured() {
+				out.Submit(submit)
+				return
+			}
+			ShowSub(uf, submit, problems)
+		case "pause":
+			paused = true
+			uf.Println(aurora.Green("Submit"), aurora.Bold("paused"))
+		case "reload":
+			ShowReload(uf, ReloadProblems(s.User()))
+		case "images":
+			images := ProblemImages(problems)
+			if out.Structured() {
+				out.Images(PrepareImages(context.Background(), images))
+				return
+			}
+			if len(images) == 0 {
+				uf.Println(aurora.Gray(15, "No images"))
+				return
+			}
+			uf.Println(aurora.Green("Preparing"), aurora.Bold(len(images)), "judge and service images")
+
+			var names, statuses, digests, errs []string
+			for _, st := range PrepareImages(context.Background(), images) {
+				names = append(names, st.Image)
+				statuses = append(statuses, st.Status)
+				digests = append(digests, ShortDigest(st.Digest))
+				if st.Err != nil {
+					errs = append(errs, OmitStr(st.Err.Error(), 60))
+				} else {
+					errs = append(errs, "")
+				}
+			}
+
+			MkTable(uf, []string{"Image", "Status", "Digest", "Error"}, []aurora.Color{aurora.BoldFm | aurora.WhiteFg, aurora.GreenFg, aurora.MagentaFg, aurora.RedFg}, [][]string{names, statuses, digests, errs})
+		case "quota":
+			if len(cmds) != 3 && len(cmds) != 4 && len(cmds) != 5 {
+				uf.Println(aurora.Red("error:"), "invalid arguments")
+				uf.Println("usage: adm quota <user> [<bytes> <inodes> | reset]")
+				return
+			}
+			user := cmds[2]
+
+			switch {
+			case len(cmds) == 4 && cmds[3] == "reset":
+				if err := ResetQuota(user); err != nil {
+					uf.Println(aurora.Red("error:"), err)
+					return
+				}
+				uf.Println(aurora.Green("Quota"), "of", aurora.Bold(user), "reset to the default")
+			case len(cmds) == 5:
+				bytes, err := ParseBytes(cmds[3])
+				if err != nil {
+					uf.Println(aurora.Red("error:"), "invalid size", aurora.Yellow(strconv.Quote(cmds[3])))
+					return
+				}
+				inodes, err := strconv.ParseInt(cmds[4], 10, 64)
+				if err != nil || inodes < 0 {
+					uf.Println(aurora.Red("error:"), "invalid inode count", aurora.Yellow(strconv.Quote(cmds[4])))
+					return
+				}
+				if err := SetQuota(Quota{User: user, Bytes: bytes, Inodes: inodes}); err != nil {
+					uf.Println(aurora.Red("error:"), err)
+					return
+				}
+				uf.Println(aurora.Green("Quota"), "of", aurora.Bold(user), "set")
+			case len(cmds) == 4:
+				uf.Println(aurora.Red("error:"), "invalid arguments")
+				uf.Println("usage: adm quota <user> [<bytes> <inodes> | reset]")
+				return
+			}
+
+			if out.Structured() {
+				out.Quota(user)
+				return
+			}
+			ShowQuota(uf, user)
+		case "gc":
+			rep := RunGC(context.Background())
+			if out.Structured() {
+				out.GC(rep)
+				return
+			}
+
+			uf.Println(aurora.Green("Stopped"), aurora.Bold(len(rep.Containers)), "orphaned containers")
+			for _, name := range rep.Containers {
+				uf.Println("	*", aurora.Yellow(name))
+			}
+			uf.Println(aurora.Green("Removed"), aurora.Bold(len(rep.Networks)), "orphaned networks")
+			uf.Println(aurora.Green("Removed"), aurora.Bold(len(rep.Workdirs)), "workdirs, freed", aurora.Bold(FormatBytes(rep.Freed)))
+			uf.Println()
+
+			var names, dirs, sizes, files []string
+			for _, u := range rep.Usage {
+				names = append(names, u.Name)
+				dirs = append(dirs, u.Dir)
+				sizes = append(sizes, FormatBytes(u.Bytes))
+				files = append(files, strconv.FormatInt(u.Files, 10))
+			}
+			MkTable(uf, []string{"Data", "Dir", "Size", "Files"}, []aurora.Color{aurora.BoldFm | aurora.WhiteFg, aurora.BlueFg, aurora.YellowFg, aurora.WhiteFg}, [][]string{names, dirs, sizes, files})
+		}
+
+	default:
+		uf.Println("unknown command", strconv.Quote(strings.Join(cmds, " ")))
 	}
 }
 
@@ -467,6 +846,9 @@ func WriteResult(uf Userface, res SubmitCtx) {
 	uf.Println()
 }
 
+// submitListColumns are the columns needed to list submissions, leaving out results and logs.
+var submitListColumns = []string{"id", "user", "problem", "submit_time", "last_update", "status", "msg", "judge_result"}
+
 func ListSubs(uf Userface, submits []SubmitCtx) {
 
 	if len(submits) == 0 {
@@ -531,10 +913,20 @@ func ShowSub(uf Userface, submit SubmitCtx, problems map[string]Problem) {
 		uf.Println("Problem:", aurora.Bold(submit.Problem), aurora.Gray(15, "(not found)"))
 	}
 
+	if submit.Commit != "" {
+		uf.Println("Commit:", aurora.Yellow(submit.Commit))
+	}
+
+	for i, wr := range submit.WorkflowResults {
+		if wr.ImageDigest != "" {
+			uf.Println("Workflow", i+1, "Image:", aurora.Bold(wr.Image), aurora.Gray(15, ShortDigest(wr.ImageDigest)))
+		}
+	}
+
 	uf.Println()
 
 	uf.Println("Logs:")
-	uf.Write(submit.Userface.Buffer.Bytes())
+	uf.Write([]byte(LoadLog(submit.LogID)))
 
 	uf.Println()
 
@@ -544,6 +936,171 @@ func ShowSub(uf Userface, submit SubmitCtx, problems map[string]Problem) {
 	// fmt.Println(string(c))
 }
 
+func ShowProblemErrors(uf Userface, errs ProblemErrors) {
+	for _, e := range errs {
+		uf.Println("	*", aurora.Yellow(e.File), aurora.Bold(e.Problem), aurora.Cyan(e.Field), e.Msg)
+	}
+}
+
+// ShowReload prints the outcome of a reload of the problems.
+func ShowReload(uf Userface, res ReloadResult) {
+	at := aurora.Gray(15, "("+res.Source+", "+res.Time.Format(time.DateTime)+")")
+	if res.Errs != nil {
+		uf.Println(aurora.Red("error:"), "problems not reloaded, keeping the", aurora.Bold(res.Problems), "loaded ones", at)
+		ShowProblemErrors(uf, res.Errs)
+		return
+	}
+	uf.Println(aurora.Green("Problems"), aurora.Bold("reloaded"), "-", aurora.Bold(res.Problems), "problems", at)
+}
+
+// ProblemSubmitCounts returns the number of submissions of every problem.
+func ProblemSubmitCounts() map[string]int64 {
+	var rows []struct {
+		Problem string
+		N       int64
+	}
+	db.Model(&SubmitCtx{}).Select("problem, count(*) as n").Group("problem").Scan(&rows)
+
+	counts := make(map[string]int64)
+	for _, r := range rows {
+		counts[r.Problem] = r.N
+	}
+	return counts
+}
+
+func ListProblems(uf Userface, problems map[string]Problem, user User, counts map[string]int64) {
+	if len(problems) == 0 {
+		uf.Println(aurora.Gray(15, "No problems"))
+		return
+	}
+
+	var ids, weights, deadlines, submits, scores []string
+	for _, pid := range SortedProblemIds(problems) {
+		pb := problems[pid]
+		ids = append(ids, pid)
+		weights = append(weights, fmt.Sprintf("%.2f", pb.Weight))
+		if pb.Deadline.IsZero() {
+			deadlines = append(deadlines, "N/A")
+		} else {
+			deadlines = append(deadlines, pb.Deadline.Local().Format(time.DateTime+" MST"))
+		}
+		submits = append(submits, strconv.FormatInt(counts[pid], 10))
+		if score, ok := user.BestScores[pid]; ok {
+			scores = append(scores, fmt.Sprintf("%.2f", score/pb.Weight))
+		} else {
+			scores = append(scores, "N/A")
+		}
+	}
+
+	MkTable(uf, []string{"Problem", "Weight", "Deadline", "Submits", "Your Score"}, []aurora.Color{aurora.BoldFm | aurora.ItalicFm, aurora.WhiteFg, aurora.YellowFg, aurora.WhiteFg, aurora.BoldFm | aurora.GreenFg}, [][]string{ids, weights, deadlines, submits, scores})
+	uf.Println()
+	uf.Println("Use 'problem <problem_id>' to show a statement")
+}
+
+func ShowProblem(uf Userface, pb Problem) {
+	uf.Println("Problem:", aurora.Bold(pb.Id))
+	uf.Println("Weight:", aurora.Bold(pb.Weight))
+	if !pb.Deadline.IsZero() {
+		if time.Now().After(pb.Deadline) {
+			uf.Println("Deadline:", aurora.Red(pb.Deadline.Local().Format(time.DateTime+" MST")), aurora.Gray(15, "(passed)"))
+		} else {
+			uf.Println("Deadline:", aurora.Yellow(pb.Deadline.Local().Format(time.DateTime+" MST")))
+		}
+	}
+	if cfg.ProblemURLPrefix != "" {
+		url := cfg.ProblemURLPrefix + pb.Id
+		uf.Println("URL:", aurora.Hyperlink(url, url))
+	}
+	uf.Println()
+
+	if strings.TrimSpace(pb.Text) == "" {
+		uf.Println(aurora.Gray(15, "No statement"))
+	} else {
+		RenderMarkdown(uf, pb.Text)
+	}
+	uf.Println()
+
+	files, err := ListAttachments(pb)
+	if err != nil {
+		log.Err(err).Str("problem", pb.Id).Msg("failed to list attachments")
+	}
+	if len(files) > 0 {
+		uf.Println("Attachments:")
+		for _, f := range files {
+			uf.Println("	*", aurora.Cyan(f.Path), aurora.Gray(15, FormatBytes(f.Size)))
+		}
+		uf.Println()
+		uf.Println("Download them with", aurora.Bold("sftp <host>:/problems/"+pb.Id+"/"), "or", aurora.Bold("scp -r <host>:/problems/"+pb.Id+" ."))
+		uf.Println("or over HTTP from", aurora.Bold("/api/v1/problems/"+pb.Id+"/attachments/<path>"))
+		uf.Println()
+	}
+
+	uf.Println("Files to submit:")
+	for _, submit := range pb.Submits {
+		if submit.IsDir {
+			uf.Println("	*", aurora.Yellow(submit.Path), aurora.Gray(15, "(directory)"))
+		} else {
+			uf.Println("	*", aurora.Yellow(submit.Path))
+		}
+	}
+	uf.Println()
+	uf.Println("Upload them to", aurora.Bold("/"+pb.Id+"/"), "with sftp or scp and run", aurora.Bold("submit "+pb.Id))
+	uf.Println("or push a commit with", aurora.Bold("git push ssh://<host>/"+pb.Id))
+}
+
+func ShowQuota(uf Userface, user string) {
+	q, override := UserQuota(user)
+	usage := WorkspaceUsage(user)
+
+	if override {
+		uf.Println("Quota of", aurora.Bold(aurora.BrightWhite(user)), aurora.Gray(15, "(set by an admin)"))
+	} else {
+		uf.Println("Quota of", aurora.Bold(aurora.BrightWhite(user)))
+	}
+
+	limit := func(used, limit int64, format func(int64) string) {
+		if limit <= 0 {
+			uf.Println(aurora.Bold(format(used)), "/", aurora.Gray(15, "unlimited"))
+			return
+		}
+		pct := float64(used) * 100 / float64(limit)
+		var c = aurora.Green
+		if pct >= 90 {
+			c = aurora.Red
+		} else if pct >= 75 {
+			c = aurora.Yellow
+		}
+		uf.Println(aurora.Bold(format(used)), "/", format(limit), c(fmt.Sprintf("(%.1f%%)", pct)))
+	}
+
+	uf.Printf("%-8s", "Space:")
+	limit(usage.Bytes, q.Bytes, FormatBytes)
+	uf.Printf("%-8s", "Inodes:")
+	limit(usage.Inodes, q.Inodes, func(n int64) string { return strconv.FormatInt(n, 10) })
+}
+
+func ListSnapshotsTable(uf Userface, snaps []Snapshot) {
+	if len(snaps) == 0 {
+		uf.Println(aurora.Gray(15, "No snapshots yet"))
+		return
+	}
+
+	var ids, dates, reasons, submits, files, sizes []string
+	for _, snap := range snaps {
+		var size int64
+		for _, f := range snap.Files {
+			size += f.Size
+		}
+		ids = append(ids, snap.ID)
+		dates = append(dates, time.Unix(0, snap.Time).Format(time.DateTime+" MST"))
+		reasons = append(reasons, snap.Reason)
+		submits = append(submits, snap.Submit)
+		files = append(files, strconv.Itoa(len(snap.Files)))
+		sizes = append(sizes, FormatBytes(size))
+	}
+	MkTable(uf, []string{"Snapshot", "Date", "Reason", "Submit ID", "Files", "Size"}, []aurora.Color{aurora.MagentaFg, aurora.YellowFg, aurora.BlueFg, aurora.MagentaFg, aurora.WhiteFg, aurora.WhiteFg}, [][]string{ids, dates, reasons, submits, files, sizes})
+}
+
 func MkTable(uf Userface, cols []string, colc []aurora.Color, data [][]string) {
 	var ColLongest = make([]int, len(cols))
 	for i, col := range cols {
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/logrusorgru/aurora/v4"
+)
+
+var (
+	mdHeading = regexp.MustCompile(`^(#{1,6})\s+(.*?)\s*#*$`)
+	mdBullet  = regexp.MustCompile(`^(\s*)[-*+]\s+(.*)$`)
+	mdNumber  = regexp.MustCompile(`^(\s*)(\d+[.)])\s+(.*)$`)
+	mdQuote   = regexp.MustCompile(`^\s*>\s?(.*)$`)
+	mdRule    = regexp.MustCompile(`^\s*(?:(?:-\s*){3,}|(?:\*\s*){3,}|(?:_\s*){3,})$`)
+
+	mdCode   = regexp.MustCompile("`([^`]+)`")
+	mdLink   = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)\)`)
+	mdBold   = regexp.MustCompile(`\*\*([^*]+)\*\*|__([^_]+)__`)
+	mdItalic = regexp.MustCompile(`\*([^*\s][^*]*)\*`)
+)
+
+// RenderMarkdown writes a problem statement for the terminal. It knows
+// headings, lists, quotes, rules, fenced code blocks and inline emphasis,
+// code and links, which covers what statements use.
+func RenderMarkdown(uf Userface, text string) {
+	var fence string // the open fence, ``` or ~~~
+
+	for _, line := range strings.Split(strings.TrimRight(strings.ReplaceAll(text, "\r\n", "\n"), "\n"), "\n") {
+		trimmed := strings.TrimSpace(line)
+
+		if fence != "" {
+			if strings.HasPrefix(trimmed, fence) {
+				fence = ""
+				continue
+			}
+			uf.Println(aurora.Gray(10, "  │"), aurora.Cyan(strings.ReplaceAll(line, "\t", "    ")))
+			continue
+		}
+		if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+			fence = trimmed[:3]
+			if lang := strings.TrimSpace(trimmed[3:]); lang != "" {
+				uf.Println(aurora.Gray(10, "  ┌ "+lang))
+			}
+			continue
+		}
+
+		switch {
+		case mdHeading.MatchString(line):
+			m := mdHeading.FindStringSubmatch(line)
+			switch len(m[1]) {
+			case 1:
+				uf.Println(aurora.Bold(aurora.Underline(aurora.BrightWhite(m[2]))))
+			case 2:
+				uf.Println(aurora.Bold(aurora.Yellow(m[2])))
+			default:
+				uf.Println(aurora.Bold(m[2]))
+			}
+		case mdRule.MatchString(line):
+			uf.Println(aurora.Gray(10, strings.Repeat("─", 40)))
+		case mdBullet.MatchString(line):
+			m := mdBullet.FindStringSubmatch(line)
+			uf.Println(m[1] + "  • " + mdInline(m[2]))
+		case mdNumber.MatchString(line):
+			m := mdNumber.FindStringSubmatch(line)
+			uf.Println(m[1]+"  "+m[2], mdInline(m[3]))
+		case mdQuote.MatchString(line):
+			m := mdQuote.FindStringSubmatch(line)
+			uf.Println(aurora.Gray(10, "  ▌"), aurora.Italic(mdInline(m[1])))
+		default:
+			uf.Println(mdInline(line))
+		}
+	}
+}
+
+// mdInline renders emphasis, code spans and links of a line.
+func mdInline(line string) string {
+	var b strings.Builder
+	last := 0
+	// code spans are taken literally
+	for _, loc := range mdCode.FindAllStringSubmatchIndex(line, -1) {
+		b.WriteString(mdEmphasis(line[last:loc[0]]))
+		b.WriteString(aurora.Cyan(line[loc[2]:loc[3]]).String())
+		last = loc[1]
+	}
+	b.WriteString(mdEmphasis(line[last:]))
+	return b.String()
+}
+
+func mdEmphasis(s string) string {
+	s = mdLink.ReplaceAllStringFunc(s, func(m string) string {
+		sub := mdLink.FindStringSubmatch(m)
+		link := aurora.Hyperlink(aurora.Underline(aurora.Blue(sub[1])), sub[2]).String()
+		if sub[1] == sub[2] {
+			return link
+		}
+		return fmt.Sprint(link, " ", aurora.Gray(15, "("+sub[2]+")"))
+	})
+	s = mdBold.ReplaceAllStringFunc(s, func(m string) string {
+		sub := mdBold.FindStringSubmatch(m)
+		return aurora.Bold(sub[1] + sub[2]).String()
+	})
+	return mdItalic.ReplaceAllStringFunc(s, func(m string) string {
+		return aurora.Italic(mdItalic.FindStringSubmatch(m)[1]).String()
+	})
+}
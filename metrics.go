@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	metricSubmissions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "soj",
+		Name:      "submissions_total",
+		Help:      "Number of finished submissions by problem and final status.",
+	}, []string{"problem", "status"})
+
+	metricJudgeDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "soj",
+		Name:      "judge_duration_seconds",
+		Help:      "Wall time of a whole judge run.",
+		Buckets:   []float64{1, 2.5, 5, 10, 20, 30, 60, 120, 180, 300, 600},
+	}, []string{"problem"})
+
+	metricWorkflowDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "soj",
+		Name:      "workflow_duration_seconds",
+		Help:      "Wall time of a single judge workflow, including container startup.",
+		Buckets:   []float64{0.5, 1, 2.5, 5, 10, 20, 30, 60, 120, 300},
+	}, []string{"problem", "workflow"})
+
+	metricStepDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "soj",
+		Name:      "step_duration_seconds",
+		Help:      "Wall time of a single workflow step executed in the judge container.",
+		Buckets:   []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120},
+	}, []string{"problem", "workflow", "step"})
+
+	metricQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "soj",
+		Name:      "judge_queue_depth",
+		Help:      "Number of submissions accepted but not yet finished.",
+	})
+
+	metricRunningContainers = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "soj",
+		Name:      "running_containers",
+		Help:      "Number of running containers started by SOJ, counted at scrape time.",
+	}, countRunningContainers)
+
+	metricContainerStartDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "soj",
+		Name:      "container_start_duration_seconds",
+		Help:      "Time spent creating and starting a container.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	metricWarmContainers = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "soj",
+		Name:      "warm_containers",
+		Help:      "Number of started judge containers waiting in warm pools.",
+	})
+
+	metricWarmPoolClaims = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "soj",
+		Name:      "warm_pool_claims_total",
+		Help:      "Number of judge workflows that found a warm container (hit) or started their own (miss).",
+	}, []string{"result"})
+
+	metricContainersReaped = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "soj",
+		Name:      "containers_reaped_total",
+		Help:      "Number of orphaned containers stopped by the garbage collector.",
+	})
+
+	metricDiskUsage = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "soj",
+		Name:      "disk_usage_bytes",
+		Help:      "Bytes used below the data directories, as of the last garbage collection.",
+	}, []string{"dir"})
+
+	metricSnapshots = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "soj",
+		Name:      "snapshots_total",
+		Help:      "Number of workspace snapshots taken by reason.",
+	}, []string{"reason"})
+
+	metricProblemReloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "soj",
+		Name:      "problem_reloads_total",
+		Help:      "Number of reloads of the problems directory by result, ok or failed.",
+	}, []string{"result"})
+
+	metricDockerErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "soj",
+		Name:      "docker_api_errors_total",
+		Help:      "Number of failed Docker API calls by operation.",
+	}, []string{"op"})
+
+	metricSSHSessions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "soj",
+		Name:      "ssh_sessions_total",
+		Help:      "Number of SSH sessions by command.",
+	}, []string{"command"})
+
+	metricSftpSessions = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "soj",
+		Name:      "sftp_sessions_total",
+		Help:      "Number of SFTP sessions opened.",
+	})
+
+	metricSftpActive = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "soj",
+		Name:      "sftp_sessions_active",
+		Help:      "Number of SFTP sessions currently open.",
+	})
+)
+
+// sshCommandLabel maps a raw command to a bounded label value,
+// so that arbitrary user input does not blow up the metric cardinality.
+func sshCommandLabel(cmds []string) string {
+	if len(cmds) == 0 {
+		return "none"
+	}
+	switch cmds[0] {
+	case "submit", "sub":
+		return "submit"
+	case "list", "ls":
+		return "list"
+	case "status", "st":
+		return "status"
+	case "rank", "rk":
+		return "rank"
+	case "my":
+		return "my"
+	case "quota":
+		return "quota"
+	case "snap":
+		return "snap"
+	case "problems", "problem":
+		return "problems"
+	case "git-receive-pack":
+		return "push"
+	case "scp":
+		return "scp"
+	case "adm":
+		return "adm"
+	default:
+		return "unknown"
+	}
+}
+
+// countRunningContainers asks the runtime, so that containers gone by
+// AutoRemove or left by an earlier process are counted right.
+func countRunningContainers() float64 {
+	if container_runtime == nil {
+		return 0
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	list, err := container_runtime.List(ctx, "soj-")
+	if err != nil {
+		metricDockerErrors.WithLabelValues("list").Inc()
+		return math.NaN()
+	}
+	var n int
+	for _, c := range list {
+		if c.Running {
+			n++
+		}
+	}
+	return float64(n)
+}
+
+// serveMetrics serves /metrics on its own listener, apart from the public
+// API. Metrics are off without MetricsAddr.
+func serveMetrics(addr string) {
+	if addr == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	go func() {
+		log.Info().Str("addr", addr).Msg("metrics server started")
+		err := http.ListenAndServe(addr, mux)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to start metrics server")
+		}
+	}()
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestCountRunningContainers(t *testing.T) {
+	fake := setupTestEnv(t)
+	bg := context.Background()
+
+	for _, name := range []string{"soj-judge-1-1", "soj-subsystem-sftp-alice", "soj-judge-2-1", "postgres"} {
+		id, err := fake.Create(bg, ContainerSpec{Name: name, Image: "alpine"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name != "soj-judge-2-1" {
+			fake.Start(bg, id)
+		}
+	}
+	if n := countRunningContainers(); n != 2 {
+		t.Errorf("counted %v running containers, want 2", n)
+	}
+
+	// a container removed behind SOJ's back is no longer counted
+	c := fake.Container("soj-judge-1-1")
+	fake.Stop(bg, c.ID, 1)
+	if n := countRunningContainers(); n != 1 {
+		t.Errorf("counted %v running containers, want 1", n)
+	}
+
+	fake.Fail["list"] = errors.New("daemon gone")
+	if n := countRunningContainers(); !math.IsNaN(n) {
+		t.Errorf("counted %v running containers without a runtime", n)
+	}
+}
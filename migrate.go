@@ -0,0 +1,400 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+// SchemaVersion records every migration applied to the database.
+type SchemaVersion struct {
+	Version   int `gorm:"primaryKey;autoIncrement:false"`
+	Name      string
+	AppliedAt int64
+}
+
+func (SchemaVersion) TableName() string { return "schema_version" }
+
+// Migration is one step of the schema history. Up and Down run inside a
+// transaction and must only use the table snapshots below, never the live
+// models, so that old migrations keep producing the same schema.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(tx *gorm.DB) error
+	Down    func(tx *gorm.DB) error
+}
+
+// Table snapshots used by migrations.
+
+type submitCtxV1 struct {
+	ID      string `gorm:"primaryKey"`
+	User    string
+	Problem string
+
+	SubmitTime int64
+	LastUpdate int64
+
+	Status string
+	Msg    string
+
+	SubmitDir       string
+	SubmitsHashes   []byte
+	Workdir         string
+	WorkflowResults []byte
+	JudgeResult     []byte
+
+	RealWorkdir string
+
+	Userface string
+}
+
+func (submitCtxV1) TableName() string { return "submit_ctxes" }
+
+type userV1 struct {
+	ID string `gorm:"primaryKey"`
+
+	BestScores     []byte
+	BestSubmits    []byte
+	BestSubmitDate []byte
+
+	TotalScore float64
+}
+
+func (userV1) TableName() string { return "users" }
+
+type submitCtxV2 struct {
+	User       string `gorm:"size:191;index"`
+	Problem    string `gorm:"size:191;index"`
+	SubmitTime int64  `gorm:"index"`
+	Status     string `gorm:"size:191;index"`
+}
+
+func (submitCtxV2) TableName() string { return "submit_ctxes" }
+
+type submitCtxV3 struct {
+	LogID string
+}
+
+func (submitCtxV3) TableName() string { return "submit_ctxes" }
+
+type judgeLogV3 struct {
+	ID   string `gorm:"primaryKey"`
+	Size int
+	Data []byte
+}
+
+func (judgeLogV3) TableName() string { return "judge_logs" }
+
+type quotaV5 struct {
+	User   string `gorm:"primaryKey;size:191"`
+	Bytes  int64
+	Inodes int64
+}
+
+func (quotaV5) TableName() string { return "quotas" }
+
+type submitCtxV6 struct {
+	Commit string
+}
+
+func (submitCtxV6) TableName() string { return "submit_ctxes" }
+
+type workflowResultV1 struct {
+	Success  bool
+	Logs     string `json:",omitempty"`
+	LogID    string `json:",omitempty"`
+	ExitCode int
+
+	Steps []struct {
+		Logs     string `json:",omitempty"`
+		LogID    string `json:",omitempty"`
+		ExitCode int
+	}
+}
+
+var migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "initial schema",
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&submitCtxV1{}, &userV1{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&submitCtxV1{}, &userV1{})
+		},
+	},
+	{
+		Version: 2,
+		Name:    "index submissions by user, problem, submit time and status",
+		Up: func(tx *gorm.DB) error {
+			m := tx.Migrator()
+			if tx.Dialector.Name() == "mysql" {
+				// mysql can not index text columns
+				for _, f := range []string{"User", "Problem", "Status"} {
+					if err := m.AlterColumn(&submitCtxV2{}, f); err != nil {
+						return err
+					}
+				}
+			}
+			return createIndexesV2(tx)
+		},
+		Down: func(tx *gorm.DB) error {
+			m := tx.Migrator()
+			for _, f := range []string{"User", "Problem", "SubmitTime", "Status"} {
+				if m.HasIndex(&submitCtxV2{}, f) {
+					if err := m.DropIndex(&submitCtxV2{}, f); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version: 3,
+		Name:    "add log store",
+		Up: func(tx *gorm.DB) error {
+			m := tx.Migrator()
+			if !m.HasColumn(&submitCtxV3{}, "LogID") {
+				if err := m.AddColumn(&submitCtxV3{}, "LogID"); err != nil {
+					return err
+				}
+			}
+			return tx.AutoMigrate(&judgeLogV3{})
+		},
+		Down: func(tx *gorm.DB) error {
+			m := tx.Migrator()
+			if err := m.DropTable(&judgeLogV3{}); err != nil {
+				return err
+			}
+			if err := m.DropColumn(&submitCtxV3{}, "LogID"); err != nil {
+				return err
+			}
+			return createIndexesV2(tx)
+		},
+	},
+	{
+		Version: 4,
+		Name:    "move inline judge logs to the log store",
+		Up: func(tx *gorm.DB) error {
+			m := tx.Migrator()
+			if !m.HasColumn(&submitCtxV1{}, "Userface") {
+				return nil
+			}
+			store := LogStoreTx(tx)
+
+			var rows []struct {
+				ID              string
+				Userface        string
+				WorkflowResults []byte
+			}
+			res := tx.Table("submit_ctxes").Select("id", "userface", "workflow_results").
+				FindInBatches(&rows, 100, func(btx *gorm.DB, batch int) error {
+					for _, r := range rows {
+						var wrs []workflowResultV1
+						if len(r.WorkflowResults) > 0 {
+							if err := json.Unmarshal(r.WorkflowResults, &wrs); err != nil {
+								return errors.New("submit " + r.ID + ": " + err.Error())
+							}
+						}
+						for i := range wrs {
+							if wrs[i].Logs != "" {
+								wrs[i].LogID = saveLogTo(store, r.ID+"-wf"+strconv.Itoa(i+1), wrs[i].Logs)
+								wrs[i].Logs = ""
+							}
+							for j := range wrs[i].Steps {
+								if wrs[i].Steps[j].Logs != "" {
+									wrs[i].Steps[j].LogID = saveLogTo(store, r.ID+"-wf"+strconv.Itoa(i+1)+"-s"+strconv.Itoa(j+1), wrs[i].Steps[j].Logs)
+									wrs[i].Steps[j].Logs = ""
+								}
+							}
+						}
+						updates := map[string]interface{}{}
+						if wrs != nil {
+							b, err := json.Marshal(wrs)
+							if err != nil {
+								return err
+							}
+							updates["workflow_results"] = b
+						}
+						if r.Userface != "" {
+							updates["log_id"] = saveLogTo(store, r.ID, r.Userface)
+						}
+						if len(updates) == 0 {
+							continue
+						}
+						err := tx.Table("submit_ctxes").Where("id = ?", r.ID).Updates(updates).Error
+						if err != nil {
+							return err
+						}
+					}
+					return nil
+				})
+			if res.Error != nil {
+				return res.Error
+			}
+
+			if err := m.DropColumn(&submitCtxV1{}, "Userface"); err != nil {
+				return err
+			}
+			// sqlite drops columns by recreating the table, which loses its indexes
+			return createIndexesV2(tx)
+		},
+		// Workflow logs stay in the log store, only the user facing log is inlined again.
+		Down: func(tx *gorm.DB) error {
+			m := tx.Migrator()
+			if err := m.AddColumn(&submitCtxV1{}, "Userface"); err != nil {
+				return err
+			}
+			store := LogStoreTx(tx)
+
+			var rows []struct {
+				ID    string
+				LogID string
+			}
+			res := tx.Table("submit_ctxes").Select("id", "log_id").Where("log_id <> ?", "").
+				FindInBatches(&rows, 100, func(btx *gorm.DB, batch int) error {
+					for _, r := range rows {
+						err := tx.Table("submit_ctxes").Where("id = ?", r.ID).Update("userface", loadLogFrom(store, r.LogID)).Error
+						if err != nil {
+							return err
+						}
+					}
+					return nil
+				})
+			return res.Error
+		},
+	},
+	{
+		Version: 5,
+		Name:    "add per user quota overrides",
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&quotaV5{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&quotaV5{})
+		},
+	},
+	{
+		Version: 6,
+		Name:    "add commit of git submissions",
+		Up: func(tx *gorm.DB) error {
+			m := tx.Migrator()
+			if m.HasColumn(&submitCtxV6{}, "Commit") {
+				return nil
+			}
+			return m.AddColumn(&submitCtxV6{}, "Commit")
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := tx.Migrator().DropColumn(&submitCtxV6{}, "Commit"); err != nil {
+				return err
+			}
+			return createIndexesV2(tx)
+		},
+	},
+}
+
+func createIndexesV2(tx *gorm.DB) error {
+	m := tx.Migrator()
+	for _, f := range []string{"User", "Problem", "SubmitTime", "Status"} {
+		if !m.HasIndex(&submitCtxV2{}, f) {
+			if err := m.CreateIndex(&submitCtxV2{}, f); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// LatestSchemaVersion is the version this binary expects.
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// CurrentSchemaVersion returns the highest applied migration, 0 for an empty database.
+func CurrentSchemaVersion() (int, error) {
+	if !db.Migrator().HasTable(&SchemaVersion{}) {
+		return 0, nil
+	}
+	var v SchemaVersion
+	err := db.Order("version desc").Limit(1).Find(&v).Error
+	return v.Version, err
+}
+
+// CheckSchema brings a new or outdated database to the schema version of
+// this binary and refuses to run against one migrated by a newer soj.
+func CheckSchema() {
+	cur, err := CurrentSchemaVersion()
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to read schema version")
+	}
+	if cur > LatestSchemaVersion() {
+		log.Fatal().Int("version", cur).Int("latest", LatestSchemaVersion()).Msg("unknown schema version, the database was migrated by a newer soj")
+	}
+	if cur < LatestSchemaVersion() {
+		log.Info().Int("version", cur).Int("latest", LatestSchemaVersion()).Msg("migrating database schema")
+		if err := MigrateTo(LatestSchemaVersion()); err != nil {
+			log.Fatal().Err(err).Msg("failed to migrate database schema")
+		}
+	}
+}
+
+// MigrateTo applies or reverts migrations until the database is at target.
+func MigrateTo(target int) error {
+	if target < 0 || target > LatestSchemaVersion() {
+		return errors.New("invalid target version " + strconv.Itoa(target))
+	}
+
+	if err := db.AutoMigrate(&SchemaVersion{}); err != nil {
+		return err
+	}
+
+	cur, err := CurrentSchemaVersion()
+	if err != nil {
+		return err
+	}
+	if cur > LatestSchemaVersion() {
+		return errors.New("unknown schema version " + strconv.Itoa(cur))
+	}
+
+	for _, mg := range migrations {
+		if mg.Version <= cur || mg.Version > target {
+			continue
+		}
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := mg.Up(tx); err != nil {
+				return err
+			}
+			return tx.Create(&SchemaVersion{Version: mg.Version, Name: mg.Name, AppliedAt: time.Now().UnixNano()}).Error
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d (%s): %w", mg.Version, mg.Name, err)
+		}
+		log.Info().Int("version", mg.Version).Str("name", mg.Name).Msg("applied migration")
+	}
+
+	for i := len(migrations) - 1; i >= 0; i-- {
+		mg := migrations[i]
+		if mg.Version > cur || mg.Version <= target {
+			continue
+		}
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := mg.Down(tx); err != nil {
+				return err
+			}
+			return tx.Delete(&SchemaVersion{}, mg.Version).Error
+		})
+		if err != nil {
+			return fmt.Errorf("reverting migration %d (%s): %w", mg.Version, mg.Name, err)
+		}
+		log.Info().Int("version", mg.Version).Str("name", mg.Name).Msg("reverted migration")
+	}
+
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"path"
+	"testing"
+)
+
+// setupEmptyDB is setupTestEnv with a database without any schema.
+func setupEmptyDB(t *testing.T) {
+	t.Helper()
+	setupTestEnv(t)
+
+	var err error
+	db, err = OpenDB("sqlite", path.Join(t.TempDir(), "soj.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckSchemaMigratesNewDatabase(t *testing.T) {
+	setupEmptyDB(t)
+
+	CheckSchema()
+
+	cur, err := CurrentSchemaVersion()
+	if err != nil || cur != LatestSchemaVersion() {
+		t.Fatalf("at version %d (%v), want %d", cur, err, LatestSchemaVersion())
+	}
+	for _, table := range []string{"submit_ctxes", "users", "schema_version", "quotas"} {
+		if !db.Migrator().HasTable(table) {
+			t.Errorf("no table %s", table)
+		}
+	}
+}
+
+func TestMigrateDownAndUp(t *testing.T) {
+	setupEmptyDB(t)
+
+	if err := MigrateTo(LatestSchemaVersion()); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create(&SubmitCtx{ID: "1", User: "alice", Problem: "p", Status: "completed", LogID: "1"}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	for v := LatestSchemaVersion() - 1; v >= 1; v-- {
+		if err := MigrateTo(v); err != nil {
+			t.Fatalf("down to %d: %v", v, err)
+		}
+		if cur, _ := CurrentSchemaVersion(); cur != v {
+			t.Fatalf("at version %d, want %d", cur, v)
+		}
+	}
+	if err := MigrateTo(LatestSchemaVersion()); err != nil {
+		t.Fatalf("up again: %v", err)
+	}
+
+	var s SubmitCtx
+	if err := db.First(&s, "id = ?", "1").Error; err != nil || s.User != "alice" || s.Status != "completed" {
+		t.Errorf("submission not kept: %+v, %v", s, err)
+	}
+
+	if err := MigrateTo(0); err != nil {
+		t.Fatal(err)
+	}
+	if db.Migrator().HasTable("submit_ctxes") {
+		t.Error("submit_ctxes kept at version 0")
+	}
+}
+
+func TestMigrateRefusesNewerSchema(t *testing.T) {
+	setupEmptyDB(t)
+
+	if err := MigrateTo(LatestSchemaVersion()); err != nil {
+		t.Fatal(err)
+	}
+	db.Create(&SchemaVersion{Version: LatestSchemaVersion() + 1, Name: "from the future"})
+
+	if err := MigrateTo(LatestSchemaVersion()); err == nil {
+		t.Error("migrated a database of a newer soj")
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Submissions get their own internal network, soj-net-<submit id>, the
+// first time an isolated workflow runs. It lives as long as the judge run.
+const judgeNetworkPrefix = "soj-net-"
+
+// about 4.5s in total, see RemoveJudgeNetwork
+const (
+	networkRemoveTries   = 10
+	networkRemoveBackoff = 100 * time.Millisecond
+)
+
+// Isolated reports whether the workflow runs on the submission network.
+// Without a network setting it does, unless it disables the network, uses
+// host mode or JudgeNetwork is "bridge".
+func (w Workflow) Isolated() bool {
+	switch {
+	case w.Network == "isolated" || len(w.Services) > 0:
+		return true
+	case w.Network == "bridge" || w.DisableNetwork || w.NetworkHostMode:
+		return false
+	}
+	return cfg.JudgeNetwork != "bridge"
+}
+
+// JudgeNetwork returns the name of the submission network, creating it
+// on first use.
+func (ctx *SubmitCtx) JudgeNetwork(tctx context.Context) (string, error) {
+	if ctx.networkID != "" {
+		return ctx.network, nil
+	}
+
+	name := judgeNetworkPrefix + ctx.ID
+	id, err := container_runtime.CreateNetwork(tctx, name, true)
+	if err != nil {
+		log.Err(err).Str("id", ctx.ID).Str("network", name).Msg("network create error")
+		metricDockerErrors.WithLabelValues("create_network").Inc()
+		return "", err
+	}
+
+	log.Debug().Str("id", ctx.ID).Str("network", name).Str("network_id", id).Msg("network created")
+
+	ctx.network, ctx.networkID = name, id
+	return name, nil
+}
+
+// RemoveJudgeNetwork removes the submission network, if one was created.
+// The containers on it are stopped, but AutoRemove takes them off in the
+// background, so the removal is retried for a few seconds.
+func (ctx *SubmitCtx) RemoveJudgeNetwork() {
+	if ctx.networkID == "" {
+		return
+	}
+
+	var err error
+	for try := 0; try < networkRemoveTries; try++ {
+		if try > 0 {
+			time.Sleep(time.Duration(try) * networkRemoveBackoff)
+		}
+		err = container_runtime.RemoveNetwork(context.Background(), ctx.networkID)
+		if err == nil {
+			break
+		}
+		log.Debug().Err(err).Str("id", ctx.ID).Str("network", ctx.network).Int("try", try+1).Msg("network remove retry")
+	}
+	if err != nil {
+		log.Err(err).Str("id", ctx.ID).Str("network", ctx.network).Msg("network remove error")
+		metricDockerErrors.WithLabelValues("remove_network").Inc()
+		return
+	}
+
+	log.Debug().Str("id", ctx.ID).Str("network", ctx.network).Msg("network removed")
+	ctx.network, ctx.networkID = "", ""
+}
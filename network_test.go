@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestRemoveJudgeNetworkWaitsForContainers(t *testing.T) {
+	fake := setupTestEnv(t)
+
+	ctx := NewSubmitCtx(context.Background(), "alice", &Problem{Id: "p"}, nil)
+	network, err := ctx.JudgeNetwork(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := fake.Create(context.Background(), ContainerSpec{Name: "soj-judge-" + ctx.ID + "-1", Image: "alpine", Network: network})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// like AutoRemove, the container goes away a little later
+	go func() {
+		time.Sleep(250 * time.Millisecond)
+		fake.Stop(context.Background(), id, 1)
+	}()
+	ctx.RemoveJudgeNetwork()
+
+	if len(fake.Networks) != 0 || ctx.networkID != "" {
+		t.Errorf("network %s left behind", network)
+	}
+}
+
+func TestWorkflowIsolated(t *testing.T) {
+	tests := []struct {
+		name     string
+		wf       Workflow
+		judgeNet string
+		isolated bool
+	}{
+		{"default", Workflow{}, "", true},
+		{"default on bridge", Workflow{}, "bridge", false},
+		{"bridge", Workflow{Network: "bridge"}, "", false},
+		{"isolated", Workflow{Network: "isolated"}, "bridge", true},
+		{"services", Workflow{Services: []Service{{Name: "db"}}}, "bridge", true},
+		{"no network", Workflow{DisableNetwork: true}, "", false},
+		{"host", Workflow{NetworkHostMode: true}, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestEnv(t)
+			cfg.JudgeNetwork = tt.judgeNet
+
+			if got := tt.wf.Isolated(); got != tt.isolated {
+				t.Errorf("isolated %v, want %v", got, tt.isolated)
+			}
+		})
+	}
+}
+
+func TestRunJudgeOnOwnNetwork(t *testing.T) {
+	fake := setupTestEnv(t)
+
+	var networks []string
+	fake.OnExec = func(c *FakeContainer, spec ExecSpec, stdout, stderr io.Writer) int {
+		internal := false
+		for _, n := range fake.Networks {
+			internal = internal || n.Name == c.Network && n.Internal
+		}
+		if !internal {
+			t.Errorf("judge container on network %q", c.Network)
+		}
+		networks = append(networks, c.Network)
+		return writeResult(c, `{"Success": true, "Score": 100}`)
+	}
+
+	pb := Problem{
+		Id:       "p",
+		Weight:   1,
+		Submits:  []Submit{{Path: "main.c"}},
+		Workflow: []Workflow{{Image: "alpine", Steps: []string{"judge"}, Timeout: 10}},
+	}
+	src := path.Join(cfg.SubmitsDir, "alice", pb.Id)
+	os.MkdirAll(src, 0700)
+	os.WriteFile(path.Join(src, "main.c"), []byte("int main(){}"), 0600)
+
+	// concurrent submissions must not share a network
+	for range 2 {
+		ctx := NewSubmitCtx(context.Background(), "alice", &pb, io.Discard)
+		RunJudge(ctx)
+		if ctx.Status != "completed" {
+			t.Fatalf("got %s %q", ctx.Status, ctx.Msg)
+		}
+	}
+	if len(networks) != 2 || networks[0] == networks[1] {
+		t.Errorf("submissions ran on %v", networks)
+	}
+	if len(fake.Networks) != 0 {
+		t.Errorf("%d networks left behind", len(fake.Networks))
+	}
+}
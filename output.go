@@ -0,0 +1,358 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Output writes the results of SSH commands for scripts, as selected by
+// --json or --csv. Field names are stable; human readable text goes to
+// stderr meanwhile.
+type Output struct {
+	Format string // json or csv, empty for the colored text
+	W      io.Writer
+}
+
+// ParseOutputFlags takes --json and --csv out of cmds.
+func ParseOutputFlags(cmds []string) (format string, rest []string) {
+	for _, c := range cmds {
+		switch c {
+		case "--json":
+			format = "json"
+		case "--csv":
+			format = "csv"
+		default:
+			rest = append(rest, c)
+		}
+	}
+	return format, rest
+}
+
+// Structured reports whether results go out as JSON or CSV.
+func (o *Output) Structured() bool {
+	return o.Format != ""
+}
+
+// Emit writes v as JSON, or header and rows as CSV.
+func (o *Output) Emit(v interface{}, header []string, rows [][]string) {
+	switch o.Format {
+	case "json":
+		json.NewEncoder(o.W).Encode(v)
+	case "csv":
+		w := csv.NewWriter(o.W)
+		w.Write(header)
+		w.WriteAll(rows)
+	}
+}
+
+// ansiEscape matches SGR sequences and OSC 8 hyperlinks written by aurora.
+var ansiEscape = regexp.MustCompile(`\x1b\[[0-9;]*m|\x1b]8;;[^\x1b]*\x1b\\`)
+
+// noColorWriter strips colors for sessions without a PTY.
+type noColorWriter struct {
+	io.Writer
+}
+
+func (w noColorWriter) Write(p []byte) (int, error) {
+	_, err := w.Writer.Write(ansiEscape.ReplaceAll(p, nil))
+	return len(p), err
+}
+
+func formatTime(ns int64) string {
+	if ns == 0 {
+		return ""
+	}
+	return time.Unix(0, ns).Format(time.RFC3339)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+type SubmitRecord struct {
+	ID         string           `json:"id"`
+	User       string           `json:"user"`
+	Problem    string           `json:"problem"`
+	Status     string           `json:"status"`
+	Msg        string           `json:"msg"`
+	Success    bool             `json:"success"`
+	Score      float64          `json:"score"`
+	JudgeMsg   string           `json:"judge_msg"`
+	SubmitTime string           `json:"submit_time"`
+	LastUpdate string           `json:"last_update"`
+	Commit     string           `json:"commit,omitempty"`
+	Workflows  []WorkflowRecord `json:"workflows,omitempty"`
+	Log        string           `json:"log,omitempty"`
+}
+
+type WorkflowRecord struct {
+	Success     bool   `json:"success"`
+	ExitCode    int    `json:"exit_code"`
+	Image       string `json:"image,omitempty"`
+	ImageDigest string `json:"image_digest,omitempty"`
+}
+
+var submitHeader = []string{"id", "user", "problem", "status", "msg", "success", "score", "judge_msg", "submit_time", "last_update", "commit"}
+
+func NewSubmitRecord(s SubmitCtx) SubmitRecord {
+	r := SubmitRecord{
+		ID:         s.ID,
+		User:       s.User,
+		Problem:    s.Problem,
+		Status:     s.Status,
+		Msg:        s.Msg,
+		Success:    s.JudgeResult.Success,
+		Score:      s.JudgeResult.Score,
+		JudgeMsg:   s.JudgeResult.Msg,
+		SubmitTime: formatTime(s.SubmitTime),
+		LastUpdate: formatTime(s.LastUpdate),
+		Commit:     s.Commit,
+	}
+	for _, wr := range s.WorkflowResults {
+		r.Workflows = append(r.Workflows, WorkflowRecord{Success: wr.Success, ExitCode: wr.ExitCode, Image: wr.Image, ImageDigest: wr.ImageDigest})
+	}
+	return r
+}
+
+func (r SubmitRecord) row() []string {
+	return []string{r.ID, r.User, r.Problem, r.Status, r.Msg, strconv.FormatBool(r.Success), formatFloat(r.Score), r.JudgeMsg, r.SubmitTime, r.LastUpdate, r.Commit}
+}
+
+// Submits writes a list of submissions.
+func (o *Output) Submits(submits []SubmitCtx) {
+	recs := []SubmitRecord{}
+	var rows [][]string
+	for _, s := range submits {
+		r := NewSubmitRecord(s)
+		r.Workflows = nil
+		recs = append(recs, r)
+		rows = append(rows, r.row())
+	}
+	o.Emit(recs, submitHeader, rows)
+}
+
+// Submit writes a single submission, with its log in JSON.
+func (o *Output) Submit(s SubmitCtx) {
+	r := NewSubmitRecord(s)
+	if s.LogID != "" {
+		r.Log = ansiEscape.ReplaceAllString(LoadLog(s.LogID), "")
+	}
+	o.Emit(r, submitHeader, [][]string{r.row()})
+}
+
+type RankRecord struct {
+	Rank   int                `json:"rank"`
+	User   string             `json:"user"`
+	Total  float64            `json:"total"`
+	Scores map[string]float64 `json:"scores"`
+}
+
+// Rank writes the ranklist, with the best score of every problem.
+func (o *Output) Rank(users []User, problems []string) {
+	recs := []RankRecord{}
+	var rows [][]string
+	header := append([]string{"rank", "user", "total"}, problems...)
+
+	var rank int
+	for i, u := range users {
+		if i == 0 || u.TotalScore != users[i-1].TotalScore {
+			rank = i + 1
+		}
+		r := RankRecord{Rank: rank, User: u.ID, Total: u.TotalScore, Scores: map[string]float64{}}
+		row := []string{strconv.Itoa(rank), u.ID, formatFloat(u.TotalScore)}
+		for _, p := range problems {
+			r.Scores[p] = u.BestScores[p]
+			row = append(row, formatFloat(u.BestScores[p]))
+		}
+		recs = append(recs, r)
+		rows = append(rows, row)
+	}
+	o.Emit(recs, header, rows)
+}
+
+type ProblemScoreRecord struct {
+	Problem  string  `json:"problem"`
+	Solved   bool    `json:"solved"`
+	Score    float64 `json:"score"` // unweighted
+	Weight   float64 `json:"weight"`
+	SubmitID string  `json:"submit_id"`
+	Date     string  `json:"date"`
+}
+
+type UserRecord struct {
+	User     string               `json:"user"`
+	Total    float64              `json:"total"`
+	Problems []ProblemScoreRecord `json:"problems"`
+}
+
+// User writes the best submissions of a user.
+func (o *Output) User(user User, problems map[string]Problem) {
+	r := UserRecord{User: user.ID, Total: user.TotalScore, Problems: []ProblemScoreRecord{}}
+	var rows [][]string
+	for _, pid := range SortedProblemIds(problems) {
+		score, ok := user.BestScores[pid]
+		p := ProblemScoreRecord{Problem: pid, Solved: ok, Score: score / problems[pid].Weight, Weight: problems[pid].Weight}
+		if ok {
+			p.SubmitID = user.BestSubmits[pid]
+			p.Date = formatTime(user.BestSubmitDate[pid])
+		}
+		r.Problems = append(r.Problems, p)
+		rows = append(rows, []string{pid, strconv.FormatBool(ok), formatFloat(p.Score), formatFloat(p.Weight), p.SubmitID, p.Date})
+	}
+	o.Emit(r, []string{"problem", "solved", "score", "weight", "submit_id", "date"}, rows)
+}
+
+type ProblemRecord struct {
+	ID       string  `json:"id"`
+	Weight   float64 `json:"weight"`
+	Deadline string  `json:"deadline"`
+	Submits  int64   `json:"submits"` // of everyone
+	Solved   bool    `json:"solved"`
+	Score    float64 `json:"score"` // best of the user, unweighted
+}
+
+// Problems writes the problem list with the best scores of user.
+func (o *Output) Problems(problems map[string]Problem, user User, counts map[string]int64) {
+	recs := []ProblemRecord{}
+	var rows [][]string
+	for _, pid := range SortedProblemIds(problems) {
+		pb := problems[pid]
+		score, ok := user.BestScores[pid]
+		r := ProblemRecord{ID: pid, Weight: pb.Weight, Submits: counts[pid], Solved: ok, Score: score / pb.Weight}
+		if !pb.Deadline.IsZero() {
+			r.Deadline = pb.Deadline.Format(time.RFC3339)
+		}
+		recs = append(recs, r)
+		rows = append(rows, []string{r.ID, formatFloat(r.Weight), r.Deadline, strconv.FormatInt(r.Submits, 10), strconv.FormatBool(r.Solved), formatFloat(r.Score)})
+	}
+	o.Emit(recs, []string{"id", "weight", "deadline", "submits", "solved", "score"}, rows)
+}
+
+type ProblemFileRecord struct {
+	Path  string `json:"path"`
+	IsDir bool   `json:"is_dir"`
+}
+
+type StatementRecord struct {
+	ID          string              `json:"id"`
+	Weight      float64             `json:"weight"`
+	Deadline    string              `json:"deadline"`
+	Text        string              `json:"text"` // Markdown
+	Files       []ProblemFileRecord `json:"files"`
+	Attachments []AttachmentFile    `json:"attachments"`
+}
+
+// Problem writes the statement of a problem, the files to submit and the
+// attachments. CSV has the paths of the files to submit separated by spaces.
+func (o *Output) Problem(pb Problem) {
+	r := StatementRecord{ID: pb.Id, Weight: pb.Weight, Text: pb.Text, Files: []ProblemFileRecord{}, Attachments: []AttachmentFile{}}
+	if !pb.Deadline.IsZero() {
+		r.Deadline = pb.Deadline.Format(time.RFC3339)
+	}
+	var paths []string
+	for _, submit := range pb.Submits {
+		r.Files = append(r.Files, ProblemFileRecord{Path: submit.Path, IsDir: submit.IsDir})
+		paths = append(paths, submit.Path)
+	}
+	files, _ := ListAttachments(pb)
+	r.Attachments = append(r.Attachments, files...)
+	o.Emit(r, []string{"id", "weight", "deadline", "text", "files"}, [][]string{{r.ID, formatFloat(r.Weight), r.Deadline, r.Text, strings.Join(paths, " ")}})
+}
+
+type QuotaRecord struct {
+	User        string `json:"user"`
+	Override    bool   `json:"override"`
+	Bytes       int64  `json:"bytes"`
+	BytesLimit  int64  `json:"bytes_limit"` // 0 is unlimited
+	Inodes      int64  `json:"inodes"`
+	InodesLimit int64  `json:"inodes_limit"`
+}
+
+// Quota writes the quota and usage of a user.
+func (o *Output) Quota(user string) {
+	q, override := UserQuota(user)
+	usage := WorkspaceUsage(user)
+	r := QuotaRecord{User: user, Override: override, Bytes: usage.Bytes, BytesLimit: q.Bytes, Inodes: usage.Inodes, InodesLimit: q.Inodes}
+	o.Emit(r, []string{"user", "override", "bytes", "bytes_limit", "inodes", "inodes_limit"}, [][]string{{
+		r.User, strconv.FormatBool(r.Override),
+		strconv.FormatInt(r.Bytes, 10), strconv.FormatInt(r.BytesLimit, 10),
+		strconv.FormatInt(r.Inodes, 10), strconv.FormatInt(r.InodesLimit, 10),
+	}})
+}
+
+type SnapshotRecord struct {
+	ID     string `json:"id"`
+	Time   string `json:"time"`
+	Reason string `json:"reason"`
+	Submit string `json:"submit_id"`
+	Files  int    `json:"files"`
+	Bytes  int64  `json:"bytes"`
+}
+
+// Snapshots writes the snapshots of a workspace.
+func (o *Output) Snapshots(snaps []Snapshot) {
+	recs := []SnapshotRecord{}
+	var rows [][]string
+	for _, snap := range snaps {
+		r := SnapshotRecord{ID: snap.ID, Time: formatTime(snap.Time), Reason: snap.Reason, Submit: snap.Submit, Files: len(snap.Files)}
+		for _, f := range snap.Files {
+			r.Bytes += f.Size
+		}
+		recs = append(recs, r)
+		rows = append(rows, []string{r.ID, r.Time, r.Reason, r.Submit, strconv.Itoa(r.Files), strconv.FormatInt(r.Bytes, 10)})
+	}
+	o.Emit(recs, []string{"id", "time", "reason", "submit_id", "files", "bytes"}, rows)
+}
+
+type ImageRecord struct {
+	Image  string `json:"image"`
+	Status string `json:"status"`
+	Digest string `json:"digest"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Images writes the state of judge and service images.
+func (o *Output) Images(statuses []ImageStatus) {
+	recs := []ImageRecord{}
+	var rows [][]string
+	for _, st := range statuses {
+		r := ImageRecord{Image: st.Image, Status: st.Status, Digest: st.Digest}
+		if st.Err != nil {
+			r.Error = st.Err.Error()
+		}
+		recs = append(recs, r)
+		rows = append(rows, []string{r.Image, r.Status, r.Digest, r.Error})
+	}
+	o.Emit(recs, []string{"image", "status", "digest", "error"}, rows)
+}
+
+type GCRecord struct {
+	Containers []string          `json:"containers"`
+	Networks   []string          `json:"networks"`
+	Workdirs   []string          `json:"workdirs"`
+	Freed      int64             `json:"freed"`
+	Usage      []DiskUsageRecord `json:"usage"`
+}
+
+type DiskUsageRecord struct {
+	Name  string `json:"name"`
+	Dir   string `json:"dir"`
+	Bytes int64  `json:"bytes"`
+	Files int64  `json:"files"`
+}
+
+// GC writes a garbage collection report. CSV only has the disk usage.
+func (o *Output) GC(rep GCReport) {
+	r := GCRecord{Containers: append([]string{}, rep.Containers...), Networks: append([]string{}, rep.Networks...), Workdirs: append([]string{}, rep.Workdirs...), Freed: rep.Freed}
+	var rows [][]string
+	for _, u := range rep.Usage {
+		r.Usage = append(r.Usage, DiskUsageRecord{Name: u.Name, Dir: u.Dir, Bytes: u.Bytes, Files: u.Files})
+		rows = append(rows, []string{u.Name, u.Dir, strconv.FormatInt(u.Bytes, 10), strconv.FormatInt(u.Files, 10)})
+	}
+	o.Emit(r, []string{"name", "dir", "bytes", "files"}, rows)
+}
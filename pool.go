@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types/mount"
+	"github.com/rs/zerolog/log"
+)
+
+// A warm pool keeps judge containers started ahead of time for workflows
+// whose image is listed in WarmPool. A warm container serves a single
+// workflow of a single submission and is destroyed afterwards.
+//
+// Containers can not get new mounts once started, so each one is created
+// with its own job directory bound to /submits and /work. The submission
+// moves its files into that directory for the duration of the workflow.
+type warmPool struct {
+	key   string
+	spec  ContainerSpec
+	size  int
+	ready chan *WarmContainer
+
+	mu       sync.Mutex
+	starting int
+	drained  bool
+}
+
+type WarmContainer struct {
+	Name    string // warm-<key>-<time>
+	ID      string
+	Dir     string // job directory, with submits and work below
+	RealDir string // Dir under RealSubmitWorkDir
+
+	attached string // workdir of the submission whose files are in Dir
+}
+
+var (
+	warmPools   = map[string]*warmPool{}
+	warmPoolsMu sync.Mutex
+
+	// names of the warm containers not yet released, see WarmLive
+	warmLive   = map[string]struct{}{}
+	warmLiveMu sync.Mutex
+)
+
+// WarmLive reports whether the warm container and job dir called
+// warm-<...> belong to this process and are still in use.
+func WarmLive(name string) bool {
+	warmLiveMu.Lock()
+	defer warmLiveMu.Unlock()
+	_, ok := warmLive[name]
+	return ok
+}
+
+// warmKey identifies the containers a workflow spec can run in. Specs
+// passed here carry no name, env or per-submission mounts.
+func warmKey(spec ContainerSpec) string {
+	b, _ := json.Marshal(spec)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// TakeWarm returns a started container for spec, or nil if none is ready.
+// A miss creates the pool, so later submissions find one. Containers that
+// stopped while waiting, e.g. when their idle command ran out, are dropped.
+func TakeWarm(spec ContainerSpec, size int) *WarmContainer {
+	if size <= 0 {
+		return nil
+	}
+
+	p := ensureWarmPool(spec, size)
+	defer p.fill()
+
+	for {
+		select {
+		case wc := <-p.ready:
+			metricWarmContainers.Dec()
+			if !wc.alive() {
+				go wc.Release()
+				continue
+			}
+			metricWarmPoolClaims.WithLabelValues("hit").Inc()
+			return wc
+		default:
+			metricWarmPoolClaims.WithLabelValues("miss").Inc()
+			return nil
+		}
+	}
+}
+
+// WarmUp starts the pools of all workflows in problems with a configured
+// size and drains the pools no workflow uses anymore.
+func WarmUp(problems map[string]Problem) {
+	var keys = map[string]struct{}{}
+
+	for _, id := range SortedProblemIds(problems) {
+		for _, workflow := range problems[id].Workflow {
+			size := cfg.WarmPool[workflow.Image]
+			if size <= 0 || workflow.Isolated() {
+				continue
+			}
+
+			spec, err := PrepareJudgeSpec(context.Background(), workflow)
+			if err != nil {
+				log.Err(err).Str("problem", id).Str("image", workflow.Image).Msg("can not warm up judge containers")
+				continue
+			}
+			keys[warmKey(spec)] = struct{}{}
+			ensureWarmPool(spec, size).fill()
+		}
+	}
+
+	warmPoolsMu.Lock()
+	defer warmPoolsMu.Unlock()
+	for key, p := range warmPools {
+		if _, ok := keys[key]; !ok {
+			delete(warmPools, key)
+			go p.drain()
+		}
+	}
+}
+
+// PrepareJudgeSpec builds the spec a judge container of workflow is
+// created from, as RunJudge does, without the per-submission parts.
+func PrepareJudgeSpec(ctx context.Context, workflow Workflow) (ContainerSpec, error) {
+	spec := JudgeSpec(workflow)
+
+	var err error
+	spec.Image, _, err = ResolveImage(ctx, workflow.Image)
+	if err != nil {
+		return spec, err
+	}
+	_, err = workflow.Security.Apply(&spec)
+	return spec, err
+}
+
+func ensureWarmPool(spec ContainerSpec, size int) *warmPool {
+	key := warmKey(spec)
+
+	warmPoolsMu.Lock()
+	defer warmPoolsMu.Unlock()
+
+	p, ok := warmPools[key]
+	if !ok {
+		p = &warmPool{key: key, spec: spec, size: size, ready: make(chan *WarmContainer, size)}
+		warmPools[key] = p
+		log.Info().Str("image", spec.Image).Int("size", size).Str("key", key[:12]).Msg("warm pool created")
+	}
+	return p
+}
+
+// fill starts containers in the background until the pool is full.
+func (p *warmPool) fill() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for !p.drained && len(p.ready)+p.starting < p.size {
+		p.starting++
+		go func() {
+			wc := p.start()
+
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			p.starting--
+			if wc == nil {
+				return
+			}
+			if p.drained {
+				go wc.Release()
+				return
+			}
+			metricWarmContainers.Inc()
+			p.ready <- wc
+		}()
+	}
+}
+
+func (p *warmPool) start() *WarmContainer {
+	name := "warm-" + p.key[:8] + "-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+
+	warmLiveMu.Lock()
+	warmLive[name] = struct{}{}
+	warmLiveMu.Unlock()
+
+	wc := &WarmContainer{
+		Name:    name,
+		Dir:     path.Join(cfg.SubmitWorkDir, name),
+		RealDir: path.Join(cfg.RealSubmitWorkDir, name),
+	}
+
+	for _, dir := range []string{wc.Dir, path.Join(wc.Dir, "submits"), path.Join(wc.Dir, "work")} {
+		err := os.Mkdir(dir, 0700)
+		if err == nil {
+			err = os.Chown(dir, cfg.SubmitUid, cfg.SubmitGid)
+		}
+		if err != nil {
+			log.Err(err).Str("dir", dir).Msg("failed to create warm job dir")
+			os.RemoveAll(wc.Dir)
+			wc.forget()
+			return nil
+		}
+	}
+
+	spec := p.spec
+	spec.Name = "soj-judge-" + name
+	spec.Mounts = append(JobMounts(path.Join(wc.Dir, "submits"), path.Join(wc.Dir, "work")), p.spec.Mounts...)
+
+	ok, id := RunImage(context.Background(), spec)
+	if !ok {
+		os.RemoveAll(wc.Dir)
+		wc.forget()
+		// do not spin on a broken image, the next claim retries
+		time.Sleep(5 * time.Second)
+		return nil
+	}
+	wc.ID = id
+
+	log.Debug().Str("image", spec.Image).Str("id", id).Str("dir", wc.Dir).Msg("warm container ready")
+	return wc
+}
+
+// alive reports whether the container is still running.
+func (wc *WarmContainer) alive() bool {
+	info, err := container_runtime.Inspect(context.Background(), wc.ID)
+	if err != nil {
+		metricDockerErrors.WithLabelValues("inspect").Inc()
+		log.Err(err).Str("id", wc.ID).Msg("failed to inspect warm container, dropping it")
+		return false
+	}
+	if !info.Running {
+		log.Info().Str("id", wc.ID).Str("name", wc.Name).Msg("warm container stopped, dropping it")
+	}
+	return info.Running
+}
+
+func (p *warmPool) drain() {
+	p.mu.Lock()
+	p.drained = true
+	p.mu.Unlock()
+
+	for {
+		select {
+		case wc := <-p.ready:
+			metricWarmContainers.Dec()
+			wc.Release()
+		default:
+			log.Info().Str("image", p.spec.Image).Str("key", p.key[:12]).Msg("warm pool drained")
+			return
+		}
+	}
+}
+
+// Attach moves the submits and work dirs of the submission at workdir
+// into the job directory of the container.
+func (wc *WarmContainer) Attach(workdir string) error {
+	err := moveEntries(path.Join(workdir, "submits"), path.Join(wc.Dir, "submits"))
+	if err == nil {
+		err = moveEntries(path.Join(workdir, "work"), path.Join(wc.Dir, "work"))
+	}
+	wc.attached = workdir
+	if err != nil {
+		wc.Detach()
+	}
+	return err
+}
+
+// Detach moves the files back to the submission, for the next workflow
+// and the result. It does nothing if they are already back.
+func (wc *WarmContainer) Detach() error {
+	if wc.attached == "" {
+		return nil
+	}
+	workdir := wc.attached
+	wc.attached = ""
+
+	err := moveEntries(path.Join(wc.Dir, "submits"), path.Join(workdir, "submits"))
+	if err2 := moveEntries(path.Join(wc.Dir, "work"), path.Join(workdir, "work")); err == nil {
+		err = err2
+	}
+	if err != nil {
+		log.Err(err).Str("dir", wc.Dir).Str("workdir", workdir).Msg("failed to move files back from warm job dir")
+	}
+	return err
+}
+
+// Release gives the files back and destroys the container and its job dir.
+func (wc *WarmContainer) Release() {
+	defer wc.forget()
+	if wc.Detach() != nil {
+		// keep what could not be moved back
+		CleanContainer(wc.ID)
+		return
+	}
+	CleanContainer(wc.ID)
+	os.RemoveAll(wc.Dir)
+}
+
+func (wc *WarmContainer) forget() {
+	warmLiveMu.Lock()
+	delete(warmLive, wc.Name)
+	warmLiveMu.Unlock()
+}
+
+// moveEntries renames everything in src into dst, both on the same filesystem.
+func moveEntries(src, dst string) error {
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		err = os.Rename(path.Join(src, e.Name()), path.Join(dst, e.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// JobMounts are the per-submission mounts of a judge container.
+func JobMounts(submits_dir, workflow_dir string) []mount.Mount {
+	return []mount.Mount{
+		{
+			Type:     mount.TypeBind,
+			Source:   submits_dir,
+			Target:   "/submits",
+			ReadOnly: true,
+		},
+		{
+			Type:   mount.TypeBind,
+			Source: workflow_dir,
+			Target: "/work",
+		},
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTakeWarmDropsStopped(t *testing.T) {
+	fake := setupTestEnv(t)
+
+	spec := ContainerSpec{Image: "alpine", Cmd: []string{"sleep", "60"}}
+	p := ensureWarmPool(spec, 2)
+	t.Cleanup(func() {
+		warmPoolsMu.Lock()
+		delete(warmPools, p.key)
+		warmPoolsMu.Unlock()
+	})
+	// no refills, the test starts the containers itself
+	p.drained = true
+
+	dead, live := p.start(), p.start()
+	if dead == nil || live == nil {
+		t.Fatal("failed to start warm containers")
+	}
+	fake.mu.Lock()
+	fake.containers[dead.ID].Running = false
+	fake.mu.Unlock()
+	p.ready <- dead
+	p.ready <- live
+
+	if wc := TakeWarm(spec, 2); wc != live {
+		t.Fatalf("got %+v, want the running container %s", wc, live.ID)
+	}
+	live.Release()
+
+	// the stopped one is released in the background
+	for deadline := time.Now().Add(5 * time.Second); fake.Container(dead.ID) != nil || WarmLive(dead.Name); {
+		if time.Now().After(deadline) {
+			t.Fatal("stopped warm container not released")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if wc := TakeWarm(spec, 2); wc != nil {
+		t.Fatalf("got %+v from an empty pool", wc)
+	}
+}
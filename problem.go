@@ -3,6 +3,10 @@ package main
 import (
 	"log"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 	"gopkg.in/yaml.v3"
@@ -12,13 +16,45 @@ type Workflow struct {
 	Image string   `yaml:"image"`
 	Steps []string `yaml:"steps"`
 
-	Timeout         int     `yaml:"timeout"`
-	Root            bool    `yaml:"root"`
-	DisableNetwork  bool    `yaml:"disablenetwork"`
-	Show            []int   `yaml:"show"`
-	PrivilegedSteps []int   `yaml:"privilegedsteps"`
-	NetworkHostMode bool    `yaml:"networkhostmode"`
-	Mounts          []Mount `yaml:"mounts"`
+	Timeout         int      `yaml:"timeout"`
+	Root            bool     `yaml:"root"`
+	DisableNetwork  bool     `yaml:"disablenetwork"`
+	Show            []int    `yaml:"show"`
+	PrivilegedSteps []int    `yaml:"privilegedsteps"`
+	NetworkHostMode bool     `yaml:"networkhostmode"`
+	Mounts          []Mount  `yaml:"mounts"`
+	Security        Security `yaml:"security"`
+
+	// Network "isolated" puts the judge container on an internal network
+	// of the submission, shared with its services and nothing else;
+	// "bridge" on the runtime's default network, where it can reach the
+	// internet and other submissions. Unset, JudgeNetwork decides.
+	// Workflows with services are always isolated.
+	Network  string    `yaml:"network"`
+	Services []Service `yaml:"services"`
+}
+
+// Service is a sidecar container started next to the judge container,
+// reachable on the submission network under its name.
+type Service struct {
+	Name    string            `yaml:"name"`
+	Image   string            `yaml:"image"`
+	Command []string          `yaml:"command"` // overrides the image's command
+	Env     map[string]string `yaml:"env"`
+	Ports   []int             `yaml:"ports"` // passed to the steps, see ServiceEnv
+
+	HealthCheck HealthCheck `yaml:"healthcheck"`
+
+	// Security defaults to serviceSecurity, which databases run under.
+	// Set it to harden the service, starting from the judge default.
+	Security *Security `yaml:"security"`
+}
+
+// HealthCheck holds back the judge until a service is ready.
+type HealthCheck struct {
+	Cmd      string `yaml:"cmd"`      // run in the service container until it exits 0
+	Interval int    `yaml:"interval"` // seconds between tries, defaults to 1
+	Timeout  int    `yaml:"timeout"`  // seconds to become healthy, defaults to 60
 }
 
 type Mount struct {
@@ -44,16 +80,25 @@ type Problem struct {
 
 	Weight float64 `yaml:"weight"`
 
+	Deadline time.Time `yaml:"deadline"` // shown to users, zero if none
+
 	Submits []Submit `yaml:"submits"`
 
+	// Attachments is a directory of files handed out to users, relative
+	// to the problem file. Users read it under /problems/<id>/ over SFTP
+	// and scp and over HTTP, workflows at /attachments.
+	Attachments string `yaml:"attachments"`
+
 	Workflow []Workflow `yaml:"workflow"`
 }
 
-func LoadProblem(file string) Problem {
+// LoadProblem reads a problem file. Defaults are filled in, the problem is
+// not validated.
+func LoadProblem(file string) (Problem, error) {
 	_f, err := os.ReadFile(file)
 
 	if err != nil {
-		panic(err)
+		return Problem{}, err
 	}
 
 	var _p Problem
@@ -61,34 +106,78 @@ func LoadProblem(file string) Problem {
 	err = yaml.Unmarshal(_f, &_p)
 
 	if err != nil {
-		panic(errors.Wrap(err, "failed to unmarshal problem "+file))
+		return Problem{}, errors.Wrap(err, "failed to unmarshal problem")
 	}
 
 	if _p.Weight == 0 {
 		_p.Weight = 1.0
 	}
 
-	pblms = append(pblms, _p.Id)
-	return _p
+	if _p.Attachments != "" {
+		if !filepath.IsAbs(_p.Attachments) {
+			_p.Attachments = filepath.Join(filepath.Dir(file), _p.Attachments)
+		}
+		_p.Attachments, _ = filepath.Abs(_p.Attachments)
+	}
 
+	return _p, nil
 }
 
-func LoadProblemDir(dir string) map[string]Problem {
+// LoadProblemDir loads and validates every problem file in dir. If any
+// of them is broken, no problems are returned, only the errors.
+func LoadProblemDir(dir string) (map[string]Problem, ProblemErrors) {
 	_f, err := os.ReadDir(dir)
 
 	if err != nil {
-		panic(err)
+		return nil, ProblemErrors{{File: dir, Msg: err.Error()}}
 	}
 
 	var _p = make(map[string]Problem)
+	var files = make(map[string]string) // id to file
+	var errs ProblemErrors
 
 	for _, f := range _f {
-		var _pf = LoadProblem(dir + "/" + f.Name())
+		// attachments may live next to the problem files, editors leave
+		// hidden and backup files
+		if f.IsDir() || strings.HasPrefix(f.Name(), ".") || strings.HasSuffix(f.Name(), "~") {
+			continue
+		}
+		_pf, err := LoadProblem(filepath.Join(dir, f.Name()))
+		if err != nil {
+			errs = append(errs, ProblemError{File: f.Name(), Msg: err.Error()})
+			continue
+		}
+
+		errs = append(errs, ValidateProblem(f.Name(), _pf, dir)...)
+		if other, ok := files[_pf.Id]; ok && _pf.Id != "" {
+			errs = append(errs, ProblemError{File: f.Name(), Problem: _pf.Id, Field: "id", Msg: "duplicate of " + other})
+			continue
+		}
+		files[_pf.Id] = f.Name()
+
+		if _pf.Attachments != "" {
+			for i := range _pf.Workflow {
+				_pf.Workflow[i].Mounts = append(_pf.Workflow[i].Mounts, Mount{Type: "bind", Source: _pf.Attachments, Target: attachmentsTarget, ReadOnly: true})
+			}
+		}
 		_p[_pf.Id] = _pf
-		log.Println("loaded problem", _pf.Id)
 	}
 
-	return _p
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	for _, id := range SortedProblemIds(_p) {
+		log.Println("loaded problem", id)
+	}
+	return _p, nil
 }
 
-var pblms []string
+// SortedProblemIds returns the ids of problems in lexical order.
+func SortedProblemIds(problems map[string]Problem) []string {
+	var ids []string
+	for k := range problems {
+		ids = append(ids, k)
+	}
+	sort.Strings(ids)
+	return ids
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Quota limits the workspace of a user, SubmitsDir/<user>. Rows in the
+// quotas table are admin overrides of QuotaBytes and QuotaInodes.
+// Zero means unlimited.
+type Quota struct {
+	User   string `gorm:"primaryKey;size:191"`
+	Bytes  int64
+	Inodes int64
+}
+
+func (Quota) TableName() string { return "quotas" }
+
+type QuotaUsage struct {
+	Bytes  int64 // sum of file sizes
+	Inodes int64 // files and directories
+}
+
+// errQuota is what SFTP clients get when a write would go over quota.
+var errQuota = syscall.EDQUOT
+
+// UserQuota returns the limits of user, with admin overrides applied.
+func UserQuota(user string) (q Quota, override bool) {
+	tx := db.Where(&Quota{User: user}).Limit(1).Find(&q)
+	if tx.Error == nil && tx.RowsAffected > 0 {
+		return q, true
+	}
+	return Quota{User: user, Bytes: cfg.QuotaBytes, Inodes: cfg.QuotaInodes}, false
+}
+
+// SetQuota overrides the limits of a user.
+func SetQuota(q Quota) error {
+	err := db.Save(&q).Error
+	if err == nil {
+		refreshQuota(q.User)
+	}
+	return err
+}
+
+// ResetQuota drops the override of a user.
+func ResetQuota(user string) error {
+	err := db.Delete(&Quota{User: user}).Error
+	if err == nil {
+		refreshQuota(user)
+	}
+	return err
+}
+
+// WorkspaceUsage measures the workspace of user.
+func WorkspaceUsage(user string) QuotaUsage {
+	var u QuotaUsage
+	root := path.Join(cfg.SubmitsDir, user)
+	filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || p == root {
+			return nil
+		}
+		u.Inodes++
+		if d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				u.Bytes += info.Size()
+			}
+		}
+		return nil
+	})
+	return u
+}
+
+// pathUsage measures the files and directories at or below p.
+func pathUsage(p string) QuotaUsage {
+	var u QuotaUsage
+	filepath.WalkDir(p, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		u.Inodes++
+		if d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				u.Bytes += info.Size()
+			}
+		}
+		return nil
+	})
+	return u
+}
+
+// fitsQuota reports whether the workspace of user stays within its quota
+// when the paths replaced, relative to dir, are removed and files, size
+// bytes in total, are written below dir. Like reserve, shrinking always fits.
+func fitsQuota(user, dir string, replaced, files []string, size int64) bool {
+	q, _ := UserQuota(user)
+	if q.Bytes <= 0 && q.Inodes <= 0 {
+		return true
+	}
+
+	var current QuotaUsage
+	for _, p := range replaced {
+		u := pathUsage(path.Join(dir, p))
+		current.Bytes += u.Bytes
+		current.Inodes += u.Inodes
+	}
+
+	// the files and the directories made for them
+	inodes := int64(len(files))
+	dirs := map[string]struct{}{}
+	for _, f := range files {
+		for d := path.Dir(f); ; d = path.Dir(d) {
+			dirs[d] = struct{}{}
+			if d == "." {
+				break
+			}
+		}
+	}
+	for d := range dirs {
+		if _, err := os.Lstat(path.Join(dir, d)); err == nil && !below(d, replaced) {
+			continue
+		}
+		inodes++
+	}
+
+	usage := WorkspaceUsage(user)
+	if q.Bytes > 0 && size > current.Bytes && usage.Bytes-current.Bytes+size > q.Bytes {
+		return false
+	}
+	if q.Inodes > 0 && inodes > current.Inodes && usage.Inodes-current.Inodes+inodes > q.Inodes {
+		return false
+	}
+	return true
+}
+
+// below reports whether p is one of paths or inside one of them.
+func below(p string, paths []string) bool {
+	for _, r := range paths {
+		if r == "." || p == r || strings.HasPrefix(p, r+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// quotaTracker keeps the usage of a workspace while SFTP sessions change
+// it. It is measured again whenever the first session opens.
+type quotaTracker struct {
+	user string
+
+	mu       sync.Mutex
+	sessions int
+	limit    Quota
+	usage    QuotaUsage
+}
+
+var (
+	quotaTrackers   = map[string]*quotaTracker{}
+	quotaTrackersMu sync.Mutex
+)
+
+func acquireQuota(user string) *quotaTracker {
+	quotaTrackersMu.Lock()
+	defer quotaTrackersMu.Unlock()
+
+	q, ok := quotaTrackers[user]
+	if !ok {
+		q = &quotaTracker{user: user}
+		quotaTrackers[user] = q
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.sessions == 0 {
+		q.limit, _ = UserQuota(user)
+		q.usage = WorkspaceUsage(user)
+	}
+	q.sessions++
+	return q
+}
+
+func (q *quotaTracker) release() {
+	quotaTrackersMu.Lock()
+	defer quotaTrackersMu.Unlock()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.sessions--
+	if q.sessions == 0 {
+		delete(quotaTrackers, q.user)
+	}
+}
+
+func refreshQuota(user string) {
+	quotaTrackersMu.Lock()
+	q, ok := quotaTrackers[user]
+	quotaTrackersMu.Unlock()
+	if !ok {
+		return
+	}
+
+	limit, _ := UserQuota(user)
+	q.mu.Lock()
+	q.limit = limit
+	q.mu.Unlock()
+}
+
+// rescanQuota measures the workspace of user again after it was changed
+// behind the back of open SFTP sessions.
+func rescanQuota(user string) {
+	quotaTrackersMu.Lock()
+	q, ok := quotaTrackers[user]
+	quotaTrackersMu.Unlock()
+	if !ok {
+		return
+	}
+
+	usage := WorkspaceUsage(user)
+	q.mu.Lock()
+	q.usage = usage
+	q.mu.Unlock()
+}
+
+// reserve accounts for bytes and inodes about to be added, or fails
+// with errQuota if they do not fit. Shrinking always succeeds.
+func (q *quotaTracker) reserve(bytes, inodes int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if bytes > 0 && q.limit.Bytes > 0 && q.usage.Bytes+bytes > q.limit.Bytes {
+		return errQuota
+	}
+	if inodes > 0 && q.limit.Inodes > 0 && q.usage.Inodes+inodes > q.limit.Inodes {
+		return errQuota
+	}
+	q.usage.Bytes += bytes
+	q.usage.Inodes += inodes
+	return nil
+}
+
+// quotaFile is a file opened for writing through SFTP.
+type quotaFile struct {
+	*os.File
+	q    *quotaTracker
+	path string // as the client sees it
+
+	mu   sync.Mutex
+	size int64
+}
+
+func (f *quotaFile) WriteAt(b []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	grow := off + int64(len(b)) - f.size
+	if grow > 0 {
+		if err := f.q.reserve(grow, 0); err != nil {
+			return 0, &os.PathError{Op: "write", Path: f.path, Err: err}
+		}
+	}
+
+	n, err := f.File.WriteAt(b, off)
+	if end := off + int64(n); end > f.size {
+		f.size = end
+	}
+	if grow > 0 && n < len(b) {
+		// give back what was not written
+		unused := min(grow, int64(len(b)-n))
+		f.q.reserve(-unused, 0)
+	}
+	return n, err
+}
+
+// ParseBytes parses sizes like 1048576, 512K, 100M or 2G.
+func ParseBytes(s string) (int64, error) {
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		mult = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		mult = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		mult = 1 << 30
+	case strings.HasSuffix(s, "T"):
+		mult = 1 << 40
+	}
+	if mult > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, strconv.ErrSyntax
+	}
+	return n * mult, nil
+}
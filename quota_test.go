@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/memory"
+)
+
+// gitTree stores files, slash separated paths to contents, as a git tree.
+func gitTree(t *testing.T, files map[string]string) *object.Tree {
+	t.Helper()
+	st := memory.NewStorage()
+
+	var store func(prefix string) plumbing.Hash
+	store = func(prefix string) plumbing.Hash {
+		var tree object.Tree
+		seen := map[string]bool{}
+		for name, content := range files {
+			rel, ok := strings.CutPrefix(name, prefix)
+			if !ok {
+				continue
+			}
+			first, _, isDir := strings.Cut(rel, "/")
+			if seen[first] {
+				continue
+			}
+			seen[first] = true
+
+			if isDir {
+				tree.Entries = append(tree.Entries, object.TreeEntry{Name: first, Mode: filemode.Dir, Hash: store(prefix + first + "/")})
+				continue
+			}
+			obj := st.NewEncodedObject()
+			obj.SetType(plumbing.BlobObject)
+			w, _ := obj.Writer()
+			w.Write([]byte(content))
+			w.Close()
+			h, err := st.SetEncodedObject(obj)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tree.Entries = append(tree.Entries, object.TreeEntry{Name: first, Mode: filemode.Regular, Hash: h})
+		}
+		sort.Slice(tree.Entries, func(i, j int) bool { return tree.Entries[i].Name < tree.Entries[j].Name })
+
+		obj := st.NewEncodedObject()
+		if err := tree.Encode(obj); err != nil {
+			t.Fatal(err)
+		}
+		h, err := st.SetEncodedObject(obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+
+	tree, err := object.GetTree(st, store(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tree
+}
+
+func TestCheckoutSubmitsInodeQuota(t *testing.T) {
+	setupTestEnv(t)
+	cfg.QuotaInodes = 10
+
+	pb := &Problem{Id: "p", Submits: []Submit{{Path: "main.c"}, {Path: "src", IsDir: true}}}
+
+	small := map[string]string{"main.c": "int main(){}", "src/a.c": "a", "src/b.c": "b"}
+	if err := CheckoutSubmits("alice", pb, gitTree(t, small)); err != nil {
+		t.Fatal(err)
+	}
+
+	// thousands of empty files are within any byte quota
+	many := map[string]string{"main.c": "int main(){}"}
+	for i := range 1000 {
+		many["src/"+strconv.Itoa(i)] = ""
+	}
+	if err := CheckoutSubmits("alice", pb, gitTree(t, many)); !errors.Is(err, errQuota) {
+		t.Fatalf("checked out 1000 files over an inode quota of 10: %v", err)
+	}
+	if _, err := os.Stat(path.Join(cfg.SubmitsDir, "alice", "p", "src", "a.c")); err != nil {
+		t.Errorf("workspace changed by a refused push: %v", err)
+	}
+
+	// replacing files already counted fits exactly
+	cfg.QuotaInodes = WorkspaceUsage("alice").Inodes
+	if err := CheckoutSubmits("alice", pb, gitTree(t, small)); err != nil {
+		t.Errorf("same push refused: %v", err)
+	}
+}
+
+func TestRestoreSnapshotInodeQuota(t *testing.T) {
+	setupTestEnv(t)
+
+	ws := path.Join(cfg.SubmitsDir, "alice", "p")
+	os.MkdirAll(ws, 0700)
+	for i := range 20 {
+		os.WriteFile(path.Join(ws, strconv.Itoa(i)), nil, 0600)
+	}
+	snap, err := TakeSnapshot("alice", "p", "manual", "")
+	if err != nil || snap == nil {
+		t.Fatalf("no snapshot: %v", err)
+	}
+	os.RemoveAll(ws)
+	os.MkdirAll(ws, 0700)
+	os.WriteFile(path.Join(ws, "main.c"), nil, 0600)
+
+	cfg.QuotaInodes = 5
+	if _, err := RestoreSnapshot(snap); !errors.Is(err, errQuota) {
+		t.Fatalf("restored 20 files over an inode quota of 5: %v", err)
+	}
+	cfg.QuotaInodes = 0
+	if _, err := RestoreSnapshot(snap); err != nil {
+		t.Fatal(err)
+	}
+	if n := WorkspaceUsage("alice").Inodes; n != 21 {
+		t.Errorf("workspace has %d inodes after the restore, want 21", n)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog/log"
+)
+
+// The loaded problems. A reload swaps in a new map and never changes a
+// map handed out by CurrentProblems, so a command or a submission keeps
+// the problems it started with.
+var (
+	problemSet   map[string]Problem
+	problemSetMu sync.RWMutex
+
+	// serializes reloads, so that a slow one can not undo a newer one
+	reloadMu sync.Mutex
+
+	lastReload   ReloadResult
+	lastReloadMu sync.Mutex
+
+	// admin shells, told about reloads as they happen
+	reloadWatchers   = map[chan ReloadResult]struct{}{}
+	reloadWatchersMu sync.Mutex
+)
+
+// ReloadResult is the outcome of a reload of ProblemsDir.
+type ReloadResult struct {
+	Time     time.Time
+	Source   string // "watch" or the admin running adm reload
+	Problems int    // loaded, or kept on errors
+	Errs     ProblemErrors
+}
+
+// CurrentProblems returns the loaded problems. Use one map for the whole
+// of a command, it stays the same across reloads.
+func CurrentProblems() map[string]Problem {
+	problemSetMu.RLock()
+	defer problemSetMu.RUnlock()
+	return problemSet
+}
+
+// SetProblems swaps in problems.
+func SetProblems(problems map[string]Problem) {
+	problemSetMu.Lock()
+	defer problemSetMu.Unlock()
+	problemSet = problems
+}
+
+// ReloadProblems loads and validates ProblemsDir and swaps it in. If any
+// problem is broken, the loaded problems are kept. Admins are told either way.
+func ReloadProblems(source string) ReloadResult {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	res := ReloadResult{Time: time.Now(), Source: source}
+	problems, errs := LoadProblemDir(cfg.ProblemsDir)
+	if errs != nil {
+		res.Errs = errs
+		res.Problems = len(CurrentProblems())
+		for _, e := range errs {
+			log.Error().Str("file", e.File).Str("problem", e.Problem).Str("field", e.Field).Msg(e.Msg)
+		}
+		log.Error().Int("errors", len(errs)).Str("source", source).Int("kept", res.Problems).Msg("problems not reloaded")
+		metricProblemReloads.WithLabelValues("failed").Inc()
+	} else {
+		SetProblems(problems)
+		res.Problems = len(problems)
+		log.Info().Str("source", source).Int("problems", len(problems)).Msg("problems reloaded")
+		metricProblemReloads.WithLabelValues("ok").Inc()
+		WarmUp(problems)
+	}
+
+	lastReloadMu.Lock()
+	lastReload = res
+	lastReloadMu.Unlock()
+
+	reloadWatchersMu.Lock()
+	for ch := range reloadWatchers {
+		select {
+		case ch <- res:
+		default: // the shell is busy, it sees LastReload instead
+		}
+	}
+	reloadWatchersMu.Unlock()
+	return res
+}
+
+// LastReload returns the outcome of the last reload, zero before any.
+func LastReload() ReloadResult {
+	lastReloadMu.Lock()
+	defer lastReloadMu.Unlock()
+	return lastReload
+}
+
+// WatchReloads tells ch about every reload until cancel is called.
+func WatchReloads(ch chan ReloadResult) (cancel func()) {
+	reloadWatchersMu.Lock()
+	reloadWatchers[ch] = struct{}{}
+	reloadWatchersMu.Unlock()
+	return func() {
+		reloadWatchersMu.Lock()
+		delete(reloadWatchers, ch)
+		reloadWatchersMu.Unlock()
+	}
+}
+
+// WatchProblemDir reloads the problems once ProblemsDir has been quiet
+// for ProblemWatchDelay after a change, as editors and deploys write
+// several files or the same one several times.
+func WatchProblemDir() {
+	delay := cfg.ProblemWatchDelay
+	if delay < 0 {
+		return
+	}
+	if delay == 0 {
+		delay = 1000
+	}
+
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Err(err).Msg("failed to watch problems, use adm reload")
+		return
+	}
+	defer w.Close()
+	if err := w.Add(cfg.ProblemsDir); err != nil {
+		log.Err(err).Str("dir", cfg.ProblemsDir).Msg("failed to watch problems, use adm reload")
+		return
+	}
+	log.Info().Str("dir", cfg.ProblemsDir).Msg("watching problems")
+
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	for {
+		select {
+		case ev, ok := <-w.Events:
+			if !ok {
+				return
+			}
+			// the files LoadProblemDir skips, but the ..data link that
+			// mounted ConfigMaps swap; Chmod comes with touch and backups
+			name := filepath.Base(ev.Name)
+			if strings.HasPrefix(name, ".") && !strings.HasPrefix(name, "..") || strings.HasSuffix(name, "~") || ev.Op == fsnotify.Chmod {
+				continue
+			}
+			timer.Reset(time.Duration(delay) * time.Millisecond)
+		case err, ok := <-w.Errors:
+			if !ok {
+				return
+			}
+			log.Err(err).Str("dir", cfg.ProblemsDir).Msg("problem watch error")
+		case <-timer.C:
+			ReloadProblems("watch")
+		}
+	}
+}
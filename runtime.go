@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"github.com/docker/docker/api/types/mount"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Runtime is the container backend judges and subsystems run on.
+type Runtime interface {
+	Create(ctx context.Context, spec ContainerSpec) (id string, err error)
+	Start(ctx context.Context, id string) error
+	// Exec runs a command in a running container, streaming its output
+	// to stdout and stderr, and returns the exit code.
+	Exec(ctx context.Context, id string, spec ExecSpec, stdout, stderr io.Writer) (int, error)
+	Logs(ctx context.Context, id string) (string, error)
+	// Stop stops a container, which also removes it.
+	Stop(ctx context.Context, id string, timeout int) error
+	Inspect(ctx context.Context, id string) (ContainerInfo, error)
+	// List returns all containers, running or not, whose name starts with prefix.
+	List(ctx context.Context, prefix string) ([]ContainerInfo, error)
+
+	// CreateNetwork creates a bridge network. Containers on an internal
+	// network can only reach each other.
+	CreateNetwork(ctx context.Context, name string, internal bool) (id string, err error)
+	RemoveNetwork(ctx context.Context, id string) error
+	ListNetworks(ctx context.Context, prefix string) ([]NetworkInfo, error)
+
+	// ImageInspect looks up a locally available image.
+	ImageInspect(ctx context.Context, image string) (ImageInfo, error)
+	Pull(ctx context.Context, image string) error
+}
+
+type ContainerSpec struct {
+	Name     string
+	Image    string
+	Cmd      []string // defaults to the image's command
+	User     string
+	Hostname string
+	WorkDir  string
+	Env      []string
+	Mounts   []mount.Mount
+
+	MaskPaths       bool
+	ReadonlyRootfs  bool
+	NetworkDisabled bool
+	NetworkHost     bool
+	Network         string   // network to join instead of the default bridge
+	NetworkAliases  []string // names other containers on Network reach this one by
+
+	CapAdd      []string
+	CapDrop     []string
+	SecurityOpt []string
+	Tmpfs       map[string]string
+	Userns      string
+
+	StopTimeout int
+}
+
+type ExecSpec struct {
+	Cmd        []string
+	Env        []string
+	Privileged bool
+}
+
+type ContainerInfo struct {
+	ID      string
+	Name    string
+	Image   string
+	Running bool
+	IP      string
+	Created time.Time
+}
+
+type NetworkInfo struct {
+	ID      string
+	Name    string
+	Created time.Time
+}
+
+var container_runtime Runtime
+
+// RootlessRuntime is implemented by runtimes that can run containers in
+// a user namespace of an unprivileged user.
+type RootlessRuntime interface {
+	Rootless() bool
+}
+
+// AdaptSubmitIds makes the submission uid/gid usable with the runtime.
+// A rootless SOJ can not chown files to other users, and its runtime maps
+// its own uid into the containers, so workdirs are owned by SOJ itself.
+func AdaptSubmitIds() {
+	rr, ok := container_runtime.(RootlessRuntime)
+	if !ok || !rr.Rootless() {
+		return
+	}
+	uid, gid := os.Getuid(), os.Getgid()
+	if cfg.SubmitUid != uid || cfg.SubmitGid != gid {
+		log.Warn().Int("uid", cfg.SubmitUid).Int("gid", cfg.SubmitGid).Int("rootless_uid", uid).Int("rootless_gid", gid).Msg("rootless runtime, running submissions as the soj user")
+	}
+	cfg.SubmitUid = uid
+	cfg.SubmitGid = gid
+}
+
+// NewRuntime creates the runtime named by kind.
+func NewRuntime(kind string) (Runtime, error) {
+	switch kind {
+	case "", "docker":
+		return NewDockerRuntime()
+	case "podman":
+		return NewPodmanRuntime(cfg.RuntimeHost)
+	case "fake":
+		return NewFakeRuntime(), nil
+	default:
+		return nil, errors.New("unknown container runtime " + kind)
+	}
+}
+
+func RunImage(ctx context.Context, spec ContainerSpec) (ok bool, id string) {
+	start := time.Now()
+
+	name, image := spec.Name, spec.Image
+
+	ctx, span := tracer.Start(ctx, "RunImage", trace.WithAttributes(attribute.String("container.name", name), attribute.String("container.image", image)))
+	defer span.End()
+
+	id, err := container_runtime.Create(ctx, spec)
+
+	if err != nil {
+		log.Err(err).Str("name", name).Str("image", image).Msg("container create error")
+		metricDockerErrors.WithLabelValues("create").Inc()
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "container create error")
+		return false, ""
+	}
+
+	log.Debug().Str("name", name).Str("image", image).Str("id", id).Msg("container created")
+
+	span.SetAttributes(attribute.String("container.id", id))
+
+	err = container_runtime.Start(ctx, id)
+
+	if err != nil {
+		log.Err(err).Str("name", name).Str("image", image).Str("id", id).Msg("container start error")
+		metricDockerErrors.WithLabelValues("start").Inc()
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "container start error")
+		return false, ""
+	}
+
+	metricContainerStartDuration.Observe(time.Since(start).Seconds())
+
+	log.Debug().Str("name", name).Str("image", image).Str("id", id).Msg("container started")
+
+	return true, id
+}
+
+func CleanContainer(id string) {
+	err := container_runtime.Stop(context.Background(), id, 1)
+	if err != nil {
+		log.Err(err).Str("id", id).Msg("container remove error")
+		metricDockerErrors.WithLabelValues("stop").Inc()
+		return
+	}
+	log.Debug().Str("id", id).Msg("container removed")
+}
+
+func GetContainerIP(id string) string {
+	info, err := container_runtime.Inspect(context.Background(), id)
+	if err != nil {
+		log.Err(err).Str("id", id).Msg("failed to get ip: container inspect error")
+		metricDockerErrors.WithLabelValues("inspect").Inc()
+		return ""
+	}
+
+	return info.IP
+}
+
+func ExecContainer(ctx context.Context, id string, cmd string, timeout int, stdout, stderr io.Writer, env []string, privileged bool) (ec int, logs string, err error) {
+	ctx, span := tracer.Start(ctx, "ExecContainer", trace.WithAttributes(attribute.String("container.id", id), attribute.String("exec.cmd", cmd), attribute.Bool("exec.privileged", privileged)))
+	defer func() {
+		span.SetAttributes(attribute.Int("exec.exit_code", ec))
+		EndSpan(span, err)
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	buf := bytes.NewBuffer(nil)
+	var rout, rerr io.Writer = buf, buf
+	if stdout != nil && stderr != nil {
+		rout = io.MultiWriter(stdout, buf)
+		rerr = io.MultiWriter(stderr, buf)
+	}
+
+	log.Debug().Str("id", id).Str("cmd", cmd).Msg("container exec started")
+
+	ec, err = container_runtime.Exec(ctx, id, ExecSpec{
+		Cmd:        []string{"sh", "-c", cmd},
+		Env:        env,
+		Privileged: privileged,
+	}, rout, rerr)
+
+	if err != nil {
+		log.Err(err).Str("id", id).Str("cmd", cmd).Msg("container exec error")
+		metricDockerErrors.WithLabelValues("exec").Inc()
+		return -1, buf.String(), err
+	}
+
+	return ec, buf.String(), nil
+}
+
+func GetContainerLogs(ctx context.Context, id string) (string, error) {
+	logs, err := container_runtime.Logs(ctx, id)
+	if err != nil {
+		log.Err(err).Str("id", id).Msg("container logs error")
+		metricDockerErrors.WithLabelValues("logs").Inc()
+		return "", err
+	}
+	return logs, nil
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/distribution/reference"
+)
+
+// FakeRuntime is an in-memory Runtime that starts no containers.
+// Exec calls go to OnExec, which can act on the host side of the
+// container mounts through FakeContainer.HostPath, e.g. to write
+// /work/result.json. It is selected with DockerCli: fake and is
+// meant for exercising the judge without a container daemon.
+type FakeRuntime struct {
+	mu         sync.Mutex
+	seq        int
+	containers map[string]*FakeContainer
+
+	// OnExec handles an exec in c and returns its exit code.
+	// If nil every exec succeeds without output.
+	OnExec func(c *FakeContainer, spec ExecSpec, stdout, stderr io.Writer) int
+
+	// Fail makes the named operation ("create", "start", "exec", "logs",
+	// "stop", "inspect", "list", "create_network", "remove_network",
+	// "list_networks", "image_inspect" or "pull") return the given error.
+	Fail map[string]error
+
+	// Networks are the networks created and not yet removed, by id.
+	Networks map[string]*FakeNetwork
+
+	// Images overrides what ImageInspect reports, a zero ImageInfo is an
+	// image that has to be pulled first. Other images are available with
+	// a digest derived from their name.
+	Images map[string]ImageInfo
+}
+
+type FakeNetwork struct {
+	NetworkInfo
+	Internal bool
+}
+
+type FakeContainer struct {
+	ContainerSpec
+
+	ID      string
+	Running bool
+	Created time.Time
+	Execs   []ExecSpec
+	Logs    bytes.Buffer
+}
+
+func NewFakeRuntime() *FakeRuntime {
+	return &FakeRuntime{
+		containers: make(map[string]*FakeContainer),
+		Fail:       make(map[string]error),
+		Networks:   make(map[string]*FakeNetwork),
+		Images:     make(map[string]ImageInfo),
+	}
+}
+
+// HostPath maps a path inside the container to the host through its bind mounts.
+// Paths outside any mount map to "".
+func (c *FakeContainer) HostPath(p string) string {
+	p = path.Clean(p)
+	var best string
+	var res string
+	for _, m := range c.Mounts {
+		t := path.Clean(m.Target)
+		if (p == t || strings.HasPrefix(p, t+"/")) && len(t) > len(best) {
+			best = t
+			res = path.Join(m.Source, strings.TrimPrefix(p, t))
+		}
+	}
+	return res
+}
+
+// Container returns the container with the given id or name.
+func (f *FakeRuntime) Container(id string) *FakeContainer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if c, ok := f.containers[id]; ok {
+		return c
+	}
+	for _, c := range f.containers {
+		if c.Name == id {
+			return c
+		}
+	}
+	return nil
+}
+
+func (f *FakeRuntime) get(op string, id string) (*FakeContainer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.Fail[op]; err != nil {
+		return nil, err
+	}
+	c, ok := f.containers[id]
+	if !ok {
+		return nil, errors.New("no such container: " + id)
+	}
+	return c, nil
+}
+
+func (f *FakeRuntime) Create(ctx context.Context, spec ContainerSpec) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.Fail["create"]; err != nil {
+		return "", err
+	}
+	for _, c := range f.containers {
+		if c.Name == spec.Name {
+			return "", errors.New("container name " + spec.Name + " is already in use")
+		}
+	}
+	f.seq++
+	id := "fake-" + strconv.Itoa(f.seq)
+	f.containers[id] = &FakeContainer{ContainerSpec: spec, ID: id, Created: time.Now()}
+	return id, nil
+}
+
+func (f *FakeRuntime) Start(ctx context.Context, id string) error {
+	c, err := f.get("start", id)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	c.Running = true
+	f.mu.Unlock()
+	return nil
+}
+
+func (f *FakeRuntime) Exec(ctx context.Context, id string, spec ExecSpec, stdout, stderr io.Writer) (int, error) {
+	c, err := f.get("exec", id)
+	if err != nil {
+		return -1, err
+	}
+	f.mu.Lock()
+	running := c.Running
+	c.Execs = append(c.Execs, spec)
+	f.mu.Unlock()
+	if !running {
+		return -1, errors.New("container " + id + " is not running")
+	}
+	if f.OnExec == nil {
+		return 0, nil
+	}
+	logs := fakeLogWriter{f, c}
+	return f.OnExec(c, spec, io.MultiWriter(stdout, logs), io.MultiWriter(stderr, logs)), ctx.Err()
+}
+
+// fakeLogWriter appends to the logs of c under the runtime lock, as
+// execs may write while Logs reads.
+type fakeLogWriter struct {
+	f *FakeRuntime
+	c *FakeContainer
+}
+
+func (w fakeLogWriter) Write(p []byte) (int, error) {
+	w.f.mu.Lock()
+	defer w.f.mu.Unlock()
+	return w.c.Logs.Write(p)
+}
+
+func (f *FakeRuntime) Logs(ctx context.Context, id string) (string, error) {
+	c, err := f.get("logs", id)
+	if err != nil {
+		return "", err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return c.Logs.String(), nil
+}
+
+// Stop marks the container stopped and, like AutoRemove, forgets it.
+func (f *FakeRuntime) Stop(ctx context.Context, id string, timeout int) error {
+	c, err := f.get("stop", id)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	c.Running = false
+	delete(f.containers, id)
+	f.mu.Unlock()
+	return nil
+}
+
+func (f *FakeRuntime) Inspect(ctx context.Context, id string) (ContainerInfo, error) {
+	c, err := f.get("inspect", id)
+	if err != nil {
+		return ContainerInfo{}, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return ContainerInfo{ID: c.ID, Name: c.Name, Image: c.Image, Running: c.Running, Created: c.Created}, nil
+}
+
+func (f *FakeRuntime) List(ctx context.Context, prefix string) ([]ContainerInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.Fail["list"]; err != nil {
+		return nil, err
+	}
+	var res []ContainerInfo
+	for _, c := range f.containers {
+		if strings.HasPrefix(c.Name, prefix) {
+			res = append(res, ContainerInfo{ID: c.ID, Name: c.Name, Image: c.Image, Running: c.Running, Created: c.Created})
+		}
+	}
+	return res, nil
+}
+
+func (f *FakeRuntime) CreateNetwork(ctx context.Context, name string, internal bool) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.Fail["create_network"]; err != nil {
+		return "", err
+	}
+	for _, n := range f.Networks {
+		if n.Name == name {
+			return "", errors.New("network with name " + name + " already exists")
+		}
+	}
+	f.seq++
+	id := "fake-net-" + strconv.Itoa(f.seq)
+	f.Networks[id] = &FakeNetwork{NetworkInfo: NetworkInfo{ID: id, Name: name, Created: time.Now()}, Internal: internal}
+	return id, nil
+}
+
+func (f *FakeRuntime) RemoveNetwork(ctx context.Context, id string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.Fail["remove_network"]; err != nil {
+		return err
+	}
+	if _, ok := f.Networks[id]; !ok {
+		return errors.New("no such network: " + id)
+	}
+	for _, c := range f.containers {
+		if c.Network == id || c.Network == f.Networks[id].Name {
+			return errors.New("network " + id + " has active endpoints")
+		}
+	}
+	delete(f.Networks, id)
+	return nil
+}
+
+func (f *FakeRuntime) ListNetworks(ctx context.Context, prefix string) ([]NetworkInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.Fail["list_networks"]; err != nil {
+		return nil, err
+	}
+	var res []NetworkInfo
+	for _, n := range f.Networks {
+		if strings.HasPrefix(n.Name, prefix) {
+			res = append(res, n.NetworkInfo)
+		}
+	}
+	return res, nil
+}
+
+func (f *FakeRuntime) ImageInspect(ctx context.Context, image string) (ImageInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.Fail["image_inspect"]; err != nil {
+		return ImageInfo{}, err
+	}
+	info, ok := f.Images[image]
+	if !ok {
+		return fakeImage(image)
+	}
+	if info.ID == "" {
+		return ImageInfo{}, errors.New("no such image: " + image)
+	}
+	return info, nil
+}
+
+func (f *FakeRuntime) Pull(ctx context.Context, image string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.Fail["pull"]; err != nil {
+		return err
+	}
+	info, err := fakeImage(image)
+	if err != nil {
+		return err
+	}
+	f.Images[image] = info
+	return nil
+}
+
+func fakeImage(image string) (ImageInfo, error) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return ImageInfo{}, err
+	}
+	sum := sha256.Sum256([]byte(image))
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	return ImageInfo{ID: digest, RepoDigests: []string{named.Name() + "@" + digest}}, nil
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	ssh "github.com/gliderlabs/ssh"
+	"github.com/rs/zerolog/log"
+)
+
+// ScpHandler serves legacy scp, `scp -t` (sink) and `scp -f` (source), over
+// the exec channel. It sees the workspace like the builtin SFTP server:
+// chrooted to SubmitsDir/<user>, owned by SubmitUid and within quota, with
+// the problem attachments under /problems.
+func ScpHandler(sess ssh.Session) {
+	var sink, source, recursive, times, dirTarget bool
+	var paths []string
+
+	args := sess.Command()[1:]
+	for i, arg := range args {
+		if arg == "--" {
+			paths = append(paths, args[i+1:]...)
+			break
+		}
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			paths = append(paths, arg)
+			continue
+		}
+		for _, f := range arg[1:] {
+			switch f {
+			case 't':
+				sink = true
+			case 'f':
+				source = true
+			case 'r':
+				recursive = true
+			case 'p':
+				times = true
+			case 'd':
+				dirTarget = true
+			}
+		}
+	}
+
+	if sink == source || len(paths) == 0 || (sink && len(paths) != 1) {
+		fmt.Fprintln(sess.Stderr(), "usage: scp -t|-f [-r] [-p] [-d] <path>...")
+		sess.Exit(1)
+		return
+	}
+
+	fs, err := newSftpFS(sess.User())
+	if err != nil {
+		log.Err(err).Str("user", sess.User()).Msg("failed to open scp workspace")
+		sess.Exit(1)
+		return
+	}
+	fs.quota = acquireQuota(sess.User())
+	defer fs.quota.release()
+
+	c := &scpConn{fs: fs, r: bufio.NewReader(sess), w: sess, recursive: recursive, times: times}
+
+	if sink {
+		log.Debug().Str("user", sess.User()).Str("path", paths[0]).Msg("scp sink started")
+		err = c.sink(paths[0], dirTarget)
+	} else {
+		log.Debug().Str("user", sess.User()).Strs("paths", paths).Msg("scp source started")
+		err = c.source(paths)
+	}
+	if err != nil && err != io.EOF {
+		log.Err(err).Str("user", sess.User()).Msg("scp error")
+		c.fatal(err)
+	}
+	if err != nil || c.failed {
+		sess.Exit(1)
+		return
+	}
+	sess.Exit(0)
+}
+
+type scpConn struct {
+	fs *sftpFS
+	r  *bufio.Reader
+	w  io.Writer
+
+	recursive, times bool
+	failed           bool // a warning was sent
+
+	mtime, atime time.Time // from the last T record
+}
+
+var errScpProtocol = errors.New("protocol error")
+
+func (c *scpConn) ack() error {
+	_, err := c.w.Write([]byte{0})
+	return err
+}
+
+// warn reports an error the client continues after.
+func (c *scpConn) warn(p string, err error) {
+	c.failed = true
+	fmt.Fprintf(c.w, "\x01scp: %s: %s\n", p, scpError(err))
+}
+
+func (c *scpConn) fatal(err error) {
+	fmt.Fprintf(c.w, "\x02scp: %s\n", scpError(err))
+}
+
+// scpError leaves out host paths.
+func scpError(err error) string {
+	var pe *os.PathError
+	if errors.As(err, &pe) {
+		err = pe.Err
+	}
+	return err.Error()
+}
+
+// readAck waits for the client to accept the last record.
+func (c *scpConn) readAck() error {
+	b, err := c.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if b == 0 {
+		return nil
+	}
+	msg, _ := c.r.ReadString('\n')
+	return errors.New(strings.TrimSpace(msg))
+}
+
+// sink receives files into target.
+func (c *scpConn) sink(target string, dirTarget bool) error {
+	var dirs []string // client paths of the D records we are in
+
+	if isProblemsPath(target) {
+		return os.ErrPermission
+	}
+	p, err := c.fs.resolve(target)
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(p)
+	isDir := err == nil && fi.IsDir()
+	if dirTarget && !isDir {
+		return fmt.Errorf("%s: not a directory", target)
+	}
+
+	if err := c.ack(); err != nil {
+		return err
+	}
+
+	for {
+		typ, err := c.r.ReadByte()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSuffix(line, "\n")
+
+		switch typ {
+		case 'T':
+			var mtime, atime int64
+			if _, err := fmt.Sscanf(line, "%d 0 %d 0", &mtime, &atime); err != nil {
+				return errScpProtocol
+			}
+			c.mtime, c.atime = time.Unix(mtime, 0), time.Unix(atime, 0)
+			if err := c.ack(); err != nil {
+				return err
+			}
+		case 'C', 'D':
+			mode, size, name, err := parseScpRecord(line)
+			if err != nil {
+				return err
+			}
+
+			var client string
+			switch {
+			case len(dirs) > 0:
+				client = path.Join(dirs[len(dirs)-1], name)
+			case isDir:
+				client = path.Join(target, name)
+			default:
+				client = target
+			}
+
+			if typ == 'C' {
+				if err := c.ack(); err != nil {
+					return err
+				}
+				err = c.receiveFile(client, mode, size)
+				if err == io.EOF || err == io.ErrUnexpectedEOF {
+					return err
+				}
+				if err != nil {
+					c.warn(client, err)
+				} else if err := c.ack(); err != nil {
+					return err
+				}
+				continue
+			}
+
+			if !c.recursive {
+				return fmt.Errorf("%s: received directory without -r", client)
+			}
+			if err := c.makeDir(client, mode); err != nil {
+				c.warn(client, err)
+				return err
+			}
+			dirs = append(dirs, client)
+			if err := c.ack(); err != nil {
+				return err
+			}
+		case 'E':
+			if len(dirs) == 0 {
+				return errScpProtocol
+			}
+			dirs = dirs[:len(dirs)-1]
+			if err := c.ack(); err != nil {
+				return err
+			}
+		case 1, 2:
+			log.Debug().Str("user", c.fs.user).Str("msg", line).Msg("scp client error")
+			if typ == 2 {
+				return io.EOF
+			}
+		default:
+			return errScpProtocol
+		}
+	}
+}
+
+// parseScpRecord parses "<mode> <size> <name>" of C and D records.
+func parseScpRecord(line string) (os.FileMode, int64, string, error) {
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) != 3 {
+		return 0, 0, "", errScpProtocol
+	}
+	mode, err := strconv.ParseUint(parts[0], 8, 32)
+	if err != nil {
+		return 0, 0, "", errScpProtocol
+	}
+	size, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || size < 0 {
+		return 0, 0, "", errScpProtocol
+	}
+	name := parts[2]
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return 0, 0, "", fmt.Errorf("invalid name %s", strconv.Quote(name))
+	}
+	return os.FileMode(mode).Perm(), size, name, nil
+}
+
+// receiveFile reads size bytes into client, followed by the client's status.
+// The data is consumed even if it can not be stored.
+func (c *scpConn) receiveFile(client string, mode os.FileMode, size int64) error {
+	defer func() { c.mtime, c.atime = time.Time{}, time.Time{} }()
+
+	data := &io.LimitedReader{R: c.r, N: size}
+	err := c.writeFile(client, mode, data)
+	if _, err := io.Copy(io.Discard, data); err != nil {
+		return err
+	}
+	if data.N > 0 {
+		return io.ErrUnexpectedEOF
+	}
+	if st := c.readAck(); st != nil {
+		return st
+	}
+	return err
+}
+
+func (c *scpConn) writeFile(client string, mode os.FileMode, data *io.LimitedReader) error {
+	size := data.N
+	if isProblemsPath(client) {
+		return os.ErrPermission
+	}
+	p, err := c.fs.resolve(client)
+	if err != nil {
+		return err
+	}
+
+	var old int64
+	var inodes int64 = 1
+	if fi, err := os.Lstat(p); err == nil {
+		if !fi.Mode().IsRegular() {
+			return errors.New("not a regular file")
+		}
+		old, inodes = fi.Size(), 0
+	}
+	if err := c.fs.quota.reserve(size-old, inodes); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		c.fs.quota.reserve(old-size, -inodes)
+		return err
+	}
+	f.Chown(cfg.SubmitUid, cfg.SubmitGid)
+	f.Chmod(mode)
+
+	n, err := io.Copy(f, data)
+	f.Close()
+	if n < size {
+		c.fs.quota.reserve(n-size, 0)
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	if c.times && !c.mtime.IsZero() {
+		os.Chtimes(p, c.atime, c.mtime)
+	}
+	return nil
+}
+
+func (c *scpConn) makeDir(client string, mode os.FileMode) error {
+	if isProblemsPath(client) {
+		return os.ErrPermission
+	}
+	p, err := c.fs.resolve(client)
+	if err != nil {
+		return err
+	}
+	if fi, err := os.Stat(p); err == nil {
+		if !fi.IsDir() {
+			return errors.New("not a directory")
+		}
+		return nil
+	}
+
+	if err := c.fs.quota.reserve(0, 1); err != nil {
+		return err
+	}
+	if err := os.Mkdir(p, mode|0700); err != nil {
+		c.fs.quota.reserve(0, -1)
+		return err
+	}
+	os.Chown(p, cfg.SubmitUid, cfg.SubmitGid)
+	return nil
+}
+
+// source sends paths to the client.
+func (c *scpConn) source(paths []string) error {
+	if err := c.readAck(); err != nil {
+		return err
+	}
+	for _, client := range paths {
+		if err := c.send(client); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// send sends a file, or a directory with -r. Only connection errors are
+// returned, everything else is reported to the client.
+func (c *scpConn) send(client string) error {
+	p, err := c.fs.resolve(client)
+	if err != nil {
+		c.warn(client, err)
+		return nil
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		c.warn(client, err)
+		return nil
+	}
+
+	if c.times {
+		fmt.Fprintf(c.w, "T%d 0 %d 0\n", fi.ModTime().Unix(), fi.ModTime().Unix())
+		if err := c.readAck(); err != nil {
+			return err
+		}
+	}
+
+	if fi.IsDir() {
+		if !c.recursive {
+			c.warn(client, errors.New("not a regular file"))
+			return nil
+		}
+		entries, err := os.ReadDir(p)
+		if err != nil {
+			c.warn(client, err)
+			return nil
+		}
+		fmt.Fprintf(c.w, "D%04o 0 %s\n", fi.Mode().Perm(), path.Base(path.Clean("/"+client)))
+		if err := c.readAck(); err != nil {
+			return err
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+		for _, e := range entries {
+			if err := c.send(path.Join(client, e.Name())); err != nil {
+				return err
+			}
+		}
+		fmt.Fprint(c.w, "E\n")
+		return c.readAck()
+	}
+
+	if !fi.Mode().IsRegular() {
+		c.warn(client, errors.New("not a regular file"))
+		return nil
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		c.warn(client, err)
+		return nil
+	}
+	defer f.Close()
+
+	fmt.Fprintf(c.w, "C%04o %d %s\n", fi.Mode().Perm(), fi.Size(), path.Base(path.Clean("/"+client)))
+	if err := c.readAck(); err != nil {
+		return err
+	}
+	// the size is promised, pad if the file shrank meanwhile
+	n, err := io.CopyN(c.w, f, fi.Size())
+	if err != nil {
+		if _, err := io.CopyN(c.w, zeroReader{}, fi.Size()-n); err != nil {
+			return err
+		}
+		c.warn(client, errors.New("file changed while reading"))
+		return c.readAck()
+	}
+	if err := c.ack(); err != nil {
+		return err
+	}
+	return c.readAck()
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	clear(b)
+	return len(b), nil
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// scpSession is a testSession whose stdin and stdout are a pipe to the client.
+type scpSession struct {
+	testSession
+	conn net.Conn
+}
+
+func (s *scpSession) Read(p []byte) (int, error)  { return s.conn.Read(p) }
+func (s *scpSession) Write(p []byte) (int, error) { return s.conn.Write(p) }
+
+// scpClient speaks the client side of the scp protocol.
+type scpClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func (c *scpClient) send(s string) {
+	c.conn.Write([]byte(s))
+}
+
+// reply reads the answer to a record or file: empty for an ack, otherwise
+// the warning (\x01) or error (\x02) line.
+func (c *scpClient) reply() string {
+	b, err := c.r.ReadByte()
+	if err != nil {
+		return "read: " + err.Error()
+	}
+	if b == 0 {
+		return ""
+	}
+	line, _ := c.r.ReadString('\n')
+	return string(b) + strings.TrimSuffix(line, "\n")
+}
+
+// upload sends a file record and its data, returning the first answer
+// that is not an ack.
+func (c *scpClient) upload(name, data string) string {
+	c.send("C0644 " + strconv.Itoa(len(data)) + " " + name + "\n")
+	if r := c.reply(); r != "" {
+		return r
+	}
+	c.send(data + "\x00")
+	return c.reply()
+}
+
+// download acks and reads a file record and its data.
+func (c *scpClient) download() (record, data string) {
+	c.send("\x00")
+	record = c.reply()
+	if !strings.HasPrefix(record, "C") {
+		return record, ""
+	}
+	size, _ := strconv.Atoi(strings.Fields(record)[1])
+	c.send("\x00")
+	buf := make([]byte, size+1)
+	io.ReadFull(c.r, buf)
+	return record, string(buf[:size])
+}
+
+// scpRun runs `scp args...` of user with client on the other end and
+// returns the exit status.
+func scpRun(t *testing.T, user string, args []string, client func(c *scpClient)) int {
+	t.Helper()
+	sconn, cconn := net.Pipe()
+	sess := &scpSession{testSession: testSession{user: user, cmd: append([]string{"scp"}, args...)}, conn: sconn}
+
+	done := make(chan struct{})
+	go func() {
+		ScpHandler(sess)
+		sconn.Close()
+		close(done)
+	}()
+
+	client(&scpClient{conn: cconn, r: bufio.NewReader(cconn)})
+	cconn.Close()
+	<-done
+	return sess.Code
+}
+
+// setupScp makes the workspace of alice, with p/main.c, and problem p with
+// an attachment.
+func setupScp(t *testing.T) string {
+	t.Helper()
+	setupTestEnv(t)
+
+	attachments := path.Join(cfg.ProblemsDir, "files")
+	os.MkdirAll(attachments, 0700)
+	os.WriteFile(path.Join(attachments, "input.txt"), []byte("1 2"), 0600)
+	SetProblems(map[string]Problem{"p": {Id: "p", Attachments: attachments}})
+	t.Cleanup(func() { SetProblems(nil) })
+
+	ws := path.Join(cfg.SubmitsDir, "alice")
+	os.MkdirAll(path.Join(ws, "p"), 0700)
+	os.WriteFile(path.Join(ws, "p", "main.c"), []byte("int main(){}"), 0600)
+	return ws
+}
+
+func TestScpSink(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   []string
+		quota  int64
+		client func(t *testing.T, c *scpClient)
+		exit   int
+		files  map[string]string // in the workspace, empty for absent
+	}{
+		{
+			name: "file into directory",
+			args: []string{"-t", "p"},
+			client: func(t *testing.T, c *scpClient) {
+				expect(t, c.reply(), "")
+				expect(t, c.upload("test.c", "test"), "")
+			},
+			files: map[string]string{"p/test.c": "test"},
+		},
+		{
+			name: "recursive",
+			args: []string{"-r", "-t", "p"},
+			client: func(t *testing.T, c *scpClient) {
+				expect(t, c.reply(), "")
+				c.send("D0755 0 src\n")
+				expect(t, c.reply(), "")
+				expect(t, c.upload("a.c", "a"), "")
+				c.send("E\n")
+				expect(t, c.reply(), "")
+			},
+			files: map[string]string{"p/src/a.c": "a"},
+		},
+		{
+			name: "name with slash",
+			args: []string{"-t", "p"},
+			client: func(t *testing.T, c *scpClient) {
+				expect(t, c.reply(), "")
+				expect(t, c.upload("../../escape", "x"), "\x02scp: invalid name")
+			},
+			exit:  1,
+			files: map[string]string{"escape": "", "../escape": ""},
+		},
+		{
+			name: "dot dot directory",
+			args: []string{"-r", "-t", "p"},
+			client: func(t *testing.T, c *scpClient) {
+				expect(t, c.reply(), "")
+				c.send("D0755 0 ..\n")
+				expect(t, c.reply(), "\x02scp: invalid name")
+			},
+			exit: 1,
+		},
+		{
+			name: "target under problems",
+			args: []string{"-t", "/problems/p"},
+			client: func(t *testing.T, c *scpClient) {
+				expect(t, c.reply(), "\x02scp: permission denied")
+			},
+			exit: 1,
+		},
+		{
+			name: "directory under problems",
+			args: []string{"-r", "-t", "/"},
+			client: func(t *testing.T, c *scpClient) {
+				expect(t, c.reply(), "")
+				c.send("D0755 0 problems\n")
+				expect(t, c.reply(), "\x01scp: /problems: permission denied")
+			},
+			exit: 1,
+		},
+		{
+			name: "refused write is drained",
+			args: []string{"-t", "/"},
+			client: func(t *testing.T, c *scpClient) {
+				expect(t, c.reply(), "")
+				expect(t, c.upload("problems", "C0644 1 injected\n"), "\x01scp: /problems: permission denied")
+				expect(t, c.upload("after.c", "after"), "")
+			},
+			exit:  1,
+			files: map[string]string{"after.c": "after", "injected": ""},
+		},
+		{
+			name:  "quota mid transfer",
+			args:  []string{"-t", "p"},
+			quota: 20,
+			client: func(t *testing.T, c *scpClient) {
+				expect(t, c.reply(), "")
+				expect(t, c.upload("a.c", "aaaa"), "")
+				expect(t, c.upload("big.c", strings.Repeat("b", 20)), "\x01scp: p/big.c: disk quota exceeded")
+				expect(t, c.upload("c.c", "cc"), "")
+			},
+			exit:  1,
+			files: map[string]string{"p/a.c": "aaaa", "p/big.c": "", "p/c.c": "cc"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ws := setupScp(t)
+			cfg.QuotaBytes = tt.quota
+
+			exit := scpRun(t, "alice", tt.args, func(c *scpClient) { tt.client(t, c) })
+			if exit != tt.exit {
+				t.Errorf("exit status %d, want %d", exit, tt.exit)
+			}
+			for name, want := range tt.files {
+				got, err := os.ReadFile(path.Join(ws, name))
+				switch {
+				case want == "" && err == nil:
+					t.Errorf("%s written", name)
+				case want != "" && string(got) != want:
+					t.Errorf("%s is %q, want %q (%v)", name, got, want, err)
+				}
+			}
+		})
+	}
+}
+
+func TestScpSource(t *testing.T) {
+	ws := setupScp(t)
+	outside := t.TempDir()
+	os.WriteFile(path.Join(outside, "secret"), []byte("secret"), 0600)
+	os.Symlink(outside, path.Join(ws, "out"))
+
+	tests := []struct {
+		name   string
+		args   []string
+		client func(t *testing.T, c *scpClient)
+		exit   int
+	}{
+		{
+			name: "file",
+			args: []string{"-f", "p/main.c"},
+			client: func(t *testing.T, c *scpClient) {
+				record, data := c.download()
+				expect(t, record, "C0600 12 main.c")
+				expect(t, data, "int main(){}")
+				c.send("\x00")
+			},
+		},
+		{
+			name: "recursive",
+			args: []string{"-r", "-f", "p"},
+			client: func(t *testing.T, c *scpClient) {
+				c.send("\x00")
+				expect(t, c.reply(), "D0700 0 p")
+				record, data := c.download()
+				expect(t, record, "C0600 12 main.c")
+				expect(t, data, "int main(){}")
+				c.send("\x00")
+				expect(t, c.reply(), "E")
+				c.send("\x00")
+			},
+		},
+		{
+			name: "attachment",
+			args: []string{"-f", "/problems/p/input.txt"},
+			client: func(t *testing.T, c *scpClient) {
+				record, data := c.download()
+				expect(t, record, "C0600 3 input.txt")
+				expect(t, data, "1 2")
+				c.send("\x00")
+			},
+		},
+		{
+			name: "missing",
+			args: []string{"-f", "p/none.c"},
+			client: func(t *testing.T, c *scpClient) {
+				record, _ := c.download()
+				expect(t, record, "\x01scp: p/none.c: no such file or directory")
+			},
+			exit: 1,
+		},
+		{
+			name: "link out of the workspace",
+			args: []string{"-f", "out/secret"},
+			client: func(t *testing.T, c *scpClient) {
+				record, _ := c.download()
+				expect(t, record, "\x01scp: out/secret: permission denied")
+			},
+			exit: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exit := scpRun(t, "alice", tt.args, func(c *scpClient) { tt.client(t, c) })
+			if exit != tt.exit {
+				t.Errorf("exit status %d, want %d", exit, tt.exit)
+			}
+		})
+	}
+}
+
+// expect checks that got starts with want, exactly empty if want is.
+func expect(t *testing.T, got, want string) {
+	t.Helper()
+	if (want == "" && got != "") || !strings.HasPrefix(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path"
+	"slices"
+)
+
+// Security is the security profile of a judge workflow.
+// The zero value is the hardened default: all capabilities dropped, the
+// runtime's default seccomp profile, a read-only rootfs with a tmpfs on
+// /tmp and no-new-privileges. Each field relaxes one of these.
+// Containers running as root keep rootCaps, to use the workdirs owned by
+// SubmitUid.
+type Security struct {
+	KeepCaps bool     `yaml:"keepcaps"` // keep the runtime's default capabilities
+	CapAdd   []string `yaml:"capadd"`   // capabilities added back, e.g. CHOWN
+
+	// Seccomp is a seccomp JSON profile, relative to ProblemsDir,
+	// or "unconfined". Empty uses the runtime's default profile.
+	Seccomp string `yaml:"seccomp"`
+
+	WritableRootfs bool    `yaml:"writablerootfs"`
+	Tmpfs          []Tmpfs `yaml:"tmpfs"` // defaults to /tmp on a read-only rootfs
+
+	AllowNewPrivileges bool `yaml:"allownewprivileges"`
+
+	// Userns is the user namespace mode, e.g. "host" to opt out of the
+	// daemon's userns-remap, or "auto" and "keep-id" on podman.
+	Userns string `yaml:"userns"`
+}
+
+type Tmpfs struct {
+	Path    string `yaml:"path"`
+	Options string `yaml:"options"` // e.g. "rw,exec,size=256m"
+}
+
+// SecurityRecord is the security settings a workflow container actually
+// ran with, kept on the submission.
+type SecurityRecord struct {
+	CapDrop         []string          `json:",omitempty"`
+	CapAdd          []string          `json:",omitempty"`
+	Seccomp         string            `json:",omitempty"`
+	SeccompSHA256   string            `json:",omitempty"`
+	ReadonlyRootfs  bool              `json:",omitempty"`
+	Tmpfs           map[string]string `json:",omitempty"`
+	NoNewPrivileges bool              `json:",omitempty"`
+	Userns          string            `json:",omitempty"`
+}
+
+var defaultTmpfs = []Tmpfs{{Path: "/tmp", Options: "rw,exec,nosuid,nodev,size=256m"}}
+
+// rootCaps let root read, write and chown the files of other users.
+var rootCaps = []string{"CHOWN", "DAC_OVERRIDE", "FOWNER"}
+
+// Apply sets the container options of the profile on spec and returns
+// what was applied.
+func (s Security) Apply(spec *ContainerSpec) (SecurityRecord, error) {
+	var rec SecurityRecord
+
+	spec.CapAdd = s.CapAdd
+	if !s.KeepCaps {
+		spec.CapDrop = []string{"ALL"}
+		if spec.User == "0" {
+			spec.CapAdd = append([]string(nil), rootCaps...)
+			for _, c := range s.CapAdd {
+				if !slices.Contains(rootCaps, c) {
+					spec.CapAdd = append(spec.CapAdd, c)
+				}
+			}
+		}
+	}
+
+	switch s.Seccomp {
+	case "":
+		rec.Seccomp = "default"
+	case "unconfined":
+		spec.SecurityOpt = append(spec.SecurityOpt, "seccomp=unconfined")
+		rec.Seccomp = "unconfined"
+	default:
+		p := s.Seccomp
+		if !path.IsAbs(p) {
+			p = path.Join(cfg.ProblemsDir, p)
+		}
+		profile, err := os.ReadFile(p)
+		if err != nil {
+			return rec, err
+		}
+		spec.SecurityOpt = append(spec.SecurityOpt, "seccomp="+string(profile))
+		sum := sha256.Sum256(profile)
+		rec.Seccomp = s.Seccomp
+		rec.SeccompSHA256 = hex.EncodeToString(sum[:])
+	}
+
+	if !s.WritableRootfs {
+		spec.ReadonlyRootfs = true
+	}
+
+	tmpfs := s.Tmpfs
+	if len(tmpfs) == 0 && spec.ReadonlyRootfs {
+		tmpfs = defaultTmpfs
+	}
+	if len(tmpfs) > 0 {
+		spec.Tmpfs = make(map[string]string)
+		for _, t := range tmpfs {
+			spec.Tmpfs[t.Path] = t.Options
+		}
+	}
+
+	if !s.AllowNewPrivileges {
+		spec.SecurityOpt = append(spec.SecurityOpt, "no-new-privileges")
+	}
+
+	if s.Userns != "" {
+		spec.Userns = s.Userns
+	}
+
+	rec.CapDrop = spec.CapDrop
+	rec.CapAdd = spec.CapAdd
+	rec.ReadonlyRootfs = spec.ReadonlyRootfs
+	rec.Tmpfs = spec.Tmpfs
+	rec.NoNewPrivileges = !s.AllowNewPrivileges
+	rec.Userns = spec.Userns
+
+	return rec, nil
+}
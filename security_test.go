@@ -0,0 +1,48 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSecurityApply(t *testing.T) {
+	tests := []struct {
+		name     string
+		user     string
+		sec      Security
+		capDrop  []string
+		capAdd   []string
+		readonly bool
+	}{
+		{"hardened", "1000", Security{}, []string{"ALL"}, nil, true},
+		{"capadd", "1000", Security{CapAdd: []string{"NET_RAW"}}, []string{"ALL"}, []string{"NET_RAW"}, true},
+		{"root keeps file caps", "0", Security{}, []string{"ALL"}, rootCaps, true},
+		{"root capadd", "0", Security{CapAdd: []string{"CHOWN", "SYS_PTRACE"}}, []string{"ALL"}, []string{"CHOWN", "DAC_OVERRIDE", "FOWNER", "SYS_PTRACE"}, true},
+		{"root keepcaps", "0", Security{KeepCaps: true, WritableRootfs: true}, nil, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := ContainerSpec{User: tt.user}
+			rec, err := tt.sec.Apply(&spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(spec.CapDrop, tt.capDrop) || !reflect.DeepEqual(spec.CapAdd, tt.capAdd) {
+				t.Errorf("got drop %v add %v, want drop %v add %v", spec.CapDrop, spec.CapAdd, tt.capDrop, tt.capAdd)
+			}
+			if spec.ReadonlyRootfs != tt.readonly || rec.ReadonlyRootfs != tt.readonly {
+				t.Errorf("got read-only rootfs %v", spec.ReadonlyRootfs)
+			}
+			if !reflect.DeepEqual(rec.CapAdd, spec.CapAdd) {
+				t.Errorf("recorded capadd %v, applied %v", rec.CapAdd, spec.CapAdd)
+			}
+		})
+	}
+
+	// rootCaps is shared, a profile must not change it
+	spec := ContainerSpec{User: "0"}
+	Security{CapAdd: []string{"SYS_ADMIN"}}.Apply(&spec)
+	if len(rootCaps) != 3 {
+		t.Errorf("rootCaps changed to %v", rootCaps)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ServiceResult is what a service of a workflow ran with.
+type ServiceResult struct {
+	Name        string
+	Image       string
+	ImageDigest string
+	Security    SecurityRecord
+	Healthy     bool `json:",omitempty"`
+}
+
+// serviceSecurity is the profile of services without one. Databases
+// switch users and write below their rootfs; the service is only reachable
+// from the submission network.
+var serviceSecurity = Security{KeepCaps: true, WritableRootfs: true}
+
+// serviceSet holds the running services of a workflow.
+type serviceSet []string
+
+// Stop tears the services down. It does nothing the second time.
+func (s *serviceSet) Stop() {
+	for _, id := range *s {
+		CleanContainer(id)
+	}
+	*s = nil
+}
+
+// StartService starts svc for workflow idx of the submission on network
+// and waits for its health check. The caller stops the returned container.
+func StartService(tctx context.Context, ctx *SubmitCtx, idx int, svc Service, network string) (cid string, rec ServiceResult, err error) {
+	rec = ServiceResult{Name: svc.Name, Image: svc.Image}
+
+	if svc.Name == "" {
+		return "", rec, errors.New("service without a name")
+	}
+
+	var env []string
+	for _, k := range sortedKeys(svc.Env) {
+		env = append(env, k+"="+svc.Env[k])
+	}
+
+	spec := ContainerSpec{
+		Name:     "soj-judge-" + ctx.ID + "-" + strconv.Itoa(idx+1) + "-svc-" + svc.Name,
+		Cmd:      svc.Command,
+		Hostname: svc.Name,
+		Env:      env,
+
+		Network:        network,
+		NetworkAliases: []string{svc.Name},
+
+		StopTimeout: 10,
+	}
+
+	spec.Image, rec.ImageDigest, err = ResolveImage(tctx, svc.Image)
+	if err != nil {
+		return "", rec, err
+	}
+
+	sec := serviceSecurity
+	if svc.Security != nil {
+		sec = *svc.Security
+	}
+	rec.Security, err = sec.Apply(&spec)
+	if err != nil {
+		return "", rec, err
+	}
+
+	ok, cid := RunImage(tctx, spec)
+	if !ok {
+		return "", rec, errors.New("failed to run service container")
+	}
+
+	if svc.HealthCheck.Cmd == "" {
+		return cid, rec, nil
+	}
+
+	err = WaitHealthy(tctx, cid, svc.HealthCheck)
+	if err != nil {
+		CleanContainer(cid)
+		return "", rec, err
+	}
+	rec.Healthy = true
+
+	return cid, rec, nil
+}
+
+// WaitHealthy runs the health check in the container until it passes.
+func WaitHealthy(ctx context.Context, cid string, hc HealthCheck) error {
+	interval := time.Duration(max(hc.Interval, 1)) * time.Second
+	timeout := hc.Timeout
+	if timeout <= 0 {
+		timeout = 60
+	}
+	deadline := time.Now().Add(time.Duration(timeout) * time.Second)
+
+	for tries := 1; ; tries++ {
+		left := int(time.Until(deadline).Seconds())
+		ec, logs, err := ExecContainer(ctx, cid, hc.Cmd, max(left, 1), nil, nil, nil, false)
+		if err == nil && ec == 0 {
+			log.Debug().Str("container", cid).Int("tries", tries).Msg("service healthy")
+			return nil
+		}
+
+		if time.Now().Add(interval).After(deadline) {
+			log.Info().Str("container", cid).Str("cmd", hc.Cmd).Int("exitcode", ec).Str("logs", logs).AnErr("err", err).Msg("service did not become healthy")
+			return errors.New("service not healthy after " + strconv.Itoa(timeout) + "s")
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// ServiceEnv tells the steps where the services are:
+// SOJ_SERVICE_<NAME>_HOST, and _PORT and _ADDR for the first port.
+// All ports are in SOJ_SERVICE_<NAME>_PORTS, separated by commas.
+func ServiceEnv(services []Service) []string {
+	var env []string
+	for _, svc := range services {
+		prefix := "SOJ_SERVICE_" + envName(svc.Name) + "_"
+		env = append(env, prefix+"HOST="+svc.Name)
+		if len(svc.Ports) == 0 {
+			continue
+		}
+
+		var ports []string
+		for _, p := range svc.Ports {
+			ports = append(ports, strconv.Itoa(p))
+		}
+		env = append(env,
+			prefix+"PORT="+ports[0],
+			prefix+"ADDR="+svc.Name+":"+ports[0],
+			prefix+"PORTS="+strings.Join(ports, ","),
+		)
+	}
+	return env
+}
+
+// envName turns a service name like "my-db" into MY_DB.
+func envName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
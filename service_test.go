@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestServiceSecurity(t *testing.T) {
+	tests := []struct {
+		name     string
+		sec      *Security
+		capDrop  int
+		readonly bool
+	}{
+		{"default runs databases", nil, 0, false},
+		{"hardened on request", &Security{}, 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := setupTestEnv(t)
+
+			var svc *FakeContainer
+			fake.OnExec = func(c *FakeContainer, spec ExecSpec, stdout, stderr io.Writer) int {
+				if strings.HasSuffix(c.Name, "-svc-db") {
+					return 0 // health check
+				}
+				cs, _ := fake.List(context.Background(), "soj-judge-")
+				for _, ci := range cs {
+					if strings.HasSuffix(ci.Name, "-svc-db") {
+						svc = fake.Container(ci.ID)
+					}
+				}
+				return writeResult(c, `{"Success": true, "Score": 100}`)
+			}
+
+			pb := Problem{
+				Id:      "sql",
+				Weight:  1,
+				Submits: []Submit{{Path: "query.sql"}},
+				Workflow: []Workflow{{
+					Image:   "alpine",
+					Steps:   []string{"judge"},
+					Timeout: 10,
+					Services: []Service{{
+						Name:        "db",
+						Image:       "postgres:16",
+						HealthCheck: HealthCheck{Cmd: "pg_isready"},
+						Security:    tt.sec,
+					}},
+				}},
+			}
+			src := path.Join(cfg.SubmitsDir, "alice", pb.Id)
+			os.MkdirAll(src, 0700)
+			os.WriteFile(path.Join(src, "query.sql"), []byte("select 1;"), 0600)
+
+			ctx := NewSubmitCtx(context.Background(), "alice", &pb, io.Discard)
+			RunJudge(ctx)
+
+			if ctx.Status != "completed" {
+				t.Fatalf("got %s %q", ctx.Status, ctx.Msg)
+			}
+			if svc == nil {
+				t.Fatal("service not running during the judge step")
+			}
+			if len(svc.CapDrop) != tt.capDrop || svc.ReadonlyRootfs != tt.readonly {
+				t.Errorf("service ran with capdrop %v, read-only rootfs %v", svc.CapDrop, svc.ReadonlyRootfs)
+			}
+			if svc.Network == "" {
+				t.Error("service not on the submission network")
+			}
+		})
+	}
+}
+
+func TestAdmImagesPullsServices(t *testing.T) {
+	fake := setupTestEnv(t)
+	cfg.Admins = []string{"admin"}
+	fake.Images["postgres:16"] = ImageInfo{} // not pulled yet
+
+	problems := map[string]Problem{"sql": {
+		Id: "sql",
+		Workflow: []Workflow{{
+			Image:    "alpine",
+			Services: []Service{{Name: "db", Image: "postgres:16"}},
+		}},
+	}}
+	SetProblems(problems)
+	t.Cleanup(func() { SetProblems(nil) })
+
+	sess := &testSession{user: "admin"}
+	out := &Output{Format: "json", W: &sess.Out}
+	RunCommand(sess, context.Background(), Userface{Buffer: &bytes.Buffer{}, Writer: io.Discard}, out, []string{"adm", "images"})
+
+	var recs []ImageRecord
+	if err := json.Unmarshal(sess.Out.Bytes(), &recs); err != nil {
+		t.Fatalf("%v: %s", err, sess.Out.String())
+	}
+	want := []ImageRecord{{Image: "alpine", Status: "present"}, {Image: "postgres:16", Status: "pulled"}}
+	if len(recs) != len(want) {
+		t.Fatalf("got %+v", recs)
+	}
+	for i := range want {
+		if recs[i].Image != want[i].Image || recs[i].Status != want[i].Status || recs[i].Digest == "" {
+			t.Errorf("got %+v, want %+v", recs[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	ssh "github.com/gliderlabs/ssh"
+	"github.com/pkg/sftp"
+	"github.com/rs/zerolog/log"
+)
+
+// sftpFS serves the workspace of a user, SubmitsDir/<user>, as the root
+// of an in-process SFTP server. Everything created through it is owned
+// by SubmitUid and SubmitGid, nothing leads out of the workspace and
+// writes stay within the user's quota. The attachments of the problems
+// are shown read-only under /problems/<id>/.
+type sftpFS struct {
+	user  string
+	root  string // SubmitsDir/<user>
+	real  string // root with symlinks evaluated
+	quota *quotaTracker
+}
+
+// errSftpEscape is returned for paths leading out of the workspace.
+var errSftpEscape = os.ErrPermission
+
+func newSftpFS(user string) (*sftpFS, error) {
+	root := path.Join(cfg.SubmitsDir, user)
+
+	err := os.MkdirAll(root, 0700)
+	if err != nil {
+		return nil, err
+	}
+	os.Chown(root, cfg.SubmitUid, cfg.SubmitGid)
+
+	real, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, err
+	}
+	return &sftpFS{user: user, root: root, real: real}, nil
+}
+
+// isProblemsPath reports whether p is in the read-only /problems tree.
+func isProblemsPath(p string) bool {
+	p = path.Clean("/" + p)
+	return p == "/problems" || strings.HasPrefix(p, "/problems/")
+}
+
+// resolve maps an SFTP path to the host. Symlinks, which can not be made
+// through SFTP, are only followed while they stay inside the workspace.
+func (fs *sftpFS) resolve(p string) (string, error) {
+	if isProblemsPath(p) {
+		pid, name, _ := strings.Cut(strings.TrimPrefix(path.Clean("/"+p), "/problems/"), "/")
+		pb, ok := CurrentProblems()[pid]
+		if !ok {
+			return "", os.ErrNotExist
+		}
+		return AttachmentPath(pb, name)
+	}
+
+	full := path.Join(fs.root, path.Clean("/"+p))
+
+	for dir := full; ; dir = path.Dir(dir) {
+		real, err := filepath.EvalSymlinks(dir)
+		if err == nil {
+			if real != fs.real && !strings.HasPrefix(real, fs.real+"/") {
+				return "", errSftpEscape
+			}
+			break
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		if dir == fs.root {
+			return "", err
+		}
+		// a dangling symlink would be created through
+		if fi, lerr := os.Lstat(dir); lerr == nil && fi.Mode()&os.ModeSymlink != 0 {
+			return "", errSftpEscape
+		}
+	}
+	return full, nil
+}
+
+func (fs *sftpFS) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	p, err := fs.resolve(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
+
+func (fs *sftpFS) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	return fs.OpenFile(r)
+}
+
+func (fs *sftpFS) OpenFile(r *sftp.Request) (sftp.WriterAtReaderAt, error) {
+	pf := r.Pflags()
+	if isProblemsPath(r.Filepath) && (pf.Write || pf.Creat || pf.Trunc) {
+		return nil, os.ErrPermission
+	}
+
+	p, err := fs.resolve(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	var flags int
+	switch {
+	case pf.Read && pf.Write:
+		flags = os.O_RDWR
+	case pf.Write:
+		flags = os.O_WRONLY
+	default:
+		flags = os.O_RDONLY
+	}
+	if pf.Append {
+		flags |= os.O_APPEND
+	}
+	if pf.Creat {
+		flags |= os.O_CREATE
+	}
+	if pf.Trunc {
+		flags |= os.O_TRUNC
+	}
+	if pf.Excl {
+		flags |= os.O_EXCL
+	}
+
+	fi, statErr := os.Lstat(p)
+	created := os.IsNotExist(statErr) && pf.Creat
+	if created {
+		if err := fs.quota.reserve(0, 1); err != nil {
+			return nil, &os.PathError{Op: "open", Path: r.Filepath, Err: err}
+		}
+	}
+
+	f, err := os.OpenFile(p, flags, 0600)
+	if err != nil {
+		if created {
+			fs.quota.reserve(0, -1)
+		}
+		return nil, err
+	}
+	if created {
+		f.Chown(cfg.SubmitUid, cfg.SubmitGid)
+	}
+	if flags&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return f, nil
+	}
+
+	var size int64
+	if statErr == nil && fi.Mode().IsRegular() {
+		size = fi.Size()
+		if pf.Trunc {
+			fs.quota.reserve(-size, 0)
+			size = 0
+		}
+	}
+	return &quotaFile{File: f, q: fs.quota, path: r.Filepath, size: size}, nil
+}
+
+func (fs *sftpFS) Filecmd(r *sftp.Request) error {
+	if isProblemsPath(r.Filepath) || (r.Target != "" && isProblemsPath(r.Target)) {
+		return os.ErrPermission
+	}
+	p, err := fs.resolve(r.Filepath)
+	if err != nil {
+		return err
+	}
+
+	switch r.Method {
+	case "Setstat":
+		return fs.setstat(p, r)
+	case "Rename":
+		target, err := fs.resolve(r.Target)
+		if err != nil {
+			return err
+		}
+		// plain SFTP rename does not replace files
+		if _, err := os.Lstat(target); err == nil {
+			return os.ErrExist
+		}
+		return os.Rename(p, target)
+	case "Rmdir":
+		fi, err := os.Lstat(p)
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			return sftp.ErrSSHFxFailure
+		}
+		if err := os.Remove(p); err != nil {
+			return err
+		}
+		fs.quota.reserve(0, -1)
+		return nil
+	case "Remove":
+		fi, err := os.Lstat(p)
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return sftp.ErrSSHFxFailure
+		}
+		if err := os.Remove(p); err != nil {
+			return err
+		}
+		fs.quota.reserve(-regularSize(fi), -1)
+		return nil
+	case "Mkdir":
+		if err := fs.quota.reserve(0, 1); err != nil {
+			return &os.PathError{Op: "mkdir", Path: r.Filepath, Err: err}
+		}
+		err := os.Mkdir(p, 0700)
+		if err != nil {
+			fs.quota.reserve(0, -1)
+			return err
+		}
+		return os.Chown(p, cfg.SubmitUid, cfg.SubmitGid)
+	case "Link", "Symlink":
+		return sftp.ErrSSHFxOpUnsupported
+	}
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+func (fs *sftpFS) PosixRename(r *sftp.Request) error {
+	if isProblemsPath(r.Filepath) || isProblemsPath(r.Target) {
+		return os.ErrPermission
+	}
+	p, err := fs.resolve(r.Filepath)
+	if err != nil {
+		return err
+	}
+	target, err := fs.resolve(r.Target)
+	if err != nil {
+		return err
+	}
+	replaced, statErr := os.Lstat(target)
+	if err := os.Rename(p, target); err != nil {
+		return err
+	}
+	if statErr == nil && !replaced.IsDir() {
+		fs.quota.reserve(-regularSize(replaced), -1)
+	}
+	return nil
+}
+
+func regularSize(fi os.FileInfo) int64 {
+	if fi.Mode().IsRegular() {
+		return fi.Size()
+	}
+	return 0
+}
+
+// setstat applies mode, size and times. Ownership stays with SubmitUid.
+func (fs *sftpFS) setstat(p string, r *sftp.Request) error {
+	flags := r.AttrFlags()
+	attrs := r.Attributes()
+
+	if flags.UidGid {
+		return sftp.ErrSSHFxPermissionDenied
+	}
+	if flags.Permissions {
+		if err := os.Chmod(p, attrs.FileMode().Perm()); err != nil {
+			return err
+		}
+	}
+	if flags.Size {
+		fi, err := os.Lstat(p)
+		if err != nil {
+			return err
+		}
+		grow := int64(attrs.Size) - regularSize(fi)
+		if err := fs.quota.reserve(grow, 0); err != nil {
+			return &os.PathError{Op: "truncate", Path: r.Filepath, Err: err}
+		}
+		if err := os.Truncate(p, int64(attrs.Size)); err != nil {
+			fs.quota.reserve(-grow, 0)
+			return err
+		}
+	}
+	if flags.Acmodtime {
+		if err := os.Chtimes(p, time.Unix(int64(attrs.Atime), 0), time.Unix(int64(attrs.Mtime), 0)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type sftpLister []os.FileInfo
+
+func (l sftpLister) ListAt(ls []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(ls, l[offset:])
+	if n < len(ls) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (fs *sftpFS) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	if path.Clean("/"+r.Filepath) == "/problems" {
+		switch r.Method {
+		case "List":
+			return fs.listProblems(), nil
+		case "Stat":
+			return sftpLister{problemsDirInfo{}}, nil
+		}
+	}
+
+	p, err := fs.resolve(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	switch r.Method {
+	case "List":
+		entries, err := os.ReadDir(p)
+		if err != nil {
+			return nil, err
+		}
+		var infos []os.FileInfo
+		var shadowed bool
+		for _, e := range entries {
+			info, err := e.Info()
+			if err != nil {
+				continue
+			}
+			if isProblemsPath(r.Filepath) {
+				info = attachmentInfo{info, info.Name()}
+			}
+			shadowed = shadowed || e.Name() == "problems"
+			infos = append(infos, info)
+		}
+		if path.Clean("/"+r.Filepath) == "/" && !shadowed && len(fs.listProblems()) > 0 {
+			infos = append(infos, problemsDirInfo{})
+		}
+		return sftpLister(infos), nil
+	case "Stat":
+		info, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		if isProblemsPath(r.Filepath) {
+			info = attachmentInfo{info, info.Name()}
+		}
+		return sftpLister{info}, nil
+	case "Readlink":
+		return nil, sftp.ErrSSHFxOpUnsupported
+	}
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+func (fs *sftpFS) Lstat(r *sftp.Request) (sftp.ListerAt, error) {
+	if path.Clean("/"+r.Filepath) == "/problems" {
+		return sftpLister{problemsDirInfo{}}, nil
+	}
+	p, err := fs.resolve(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Lstat(p)
+	if err != nil {
+		return nil, err
+	}
+	if isProblemsPath(r.Filepath) {
+		info = attachmentInfo{info, info.Name()}
+	}
+	return sftpLister{info}, nil
+}
+
+// listProblems lists the problems with attachments, as directories.
+func (fs *sftpFS) listProblems() sftpLister {
+	var infos []os.FileInfo
+	problems := CurrentProblems()
+	for _, pid := range SortedProblemIds(problems) {
+		p, err := AttachmentPath(problems[pid], "")
+		if err != nil {
+			continue
+		}
+		info, err := os.Stat(p)
+		if err != nil || !info.IsDir() {
+			continue
+		}
+		infos = append(infos, attachmentInfo{info, pid})
+	}
+	return sftpLister(infos)
+}
+
+func (fs *sftpFS) RealPath(p string) (string, error) {
+	return path.Clean("/" + p), nil
+}
+
+// serveSftp runs the in-process SFTP server on the session.
+func serveSftp(sess ssh.Session) {
+	fs, err := newSftpFS(sess.User())
+	if err != nil {
+		log.Err(err).Str("user", sess.User()).Msg("failed to open sftp workspace")
+		return
+	}
+
+	fs.quota = acquireQuota(sess.User())
+	defer fs.quota.release()
+
+	log.Debug().Str("user", sess.User()).Str("root", fs.root).Msg("sftp session started")
+
+	server := sftp.NewRequestServer(sess, sftp.Handlers{
+		FileGet:  fs,
+		FilePut:  fs,
+		FileCmd:  fs,
+		FileList: fs,
+	})
+	defer server.Close()
+
+	err = server.Serve()
+	if err != nil && err != io.EOF {
+		log.Err(err).Str("user", sess.User()).Msg("sftp session error")
+		return
+	}
+
+	log.Debug().Str("user", sess.User()).Msg("sftp session closed")
+}
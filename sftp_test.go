@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/pkg/sftp"
+)
+
+// sftpClient serves the workspace of user over an in-memory connection.
+func sftpClient(t *testing.T, user string) *sftp.Client {
+	t.Helper()
+
+	fs, err := newSftpFS(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.quota = acquireQuota(user)
+
+	sconn, cconn := net.Pipe()
+	server := sftp.NewRequestServer(sconn, sftp.Handlers{FileGet: fs, FilePut: fs, FileCmd: fs, FileList: fs})
+	done := make(chan struct{})
+	go func() {
+		server.Serve()
+		close(done)
+	}()
+
+	client, err := sftp.NewClientPipe(cconn, cconn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+		<-done
+		fs.quota.release()
+	})
+	return client
+}
+
+func TestSftpResolve(t *testing.T) {
+	setupTestEnv(t)
+
+	outside := t.TempDir()
+	os.WriteFile(path.Join(outside, "secret"), []byte("secret"), 0600)
+
+	attachments := path.Join(cfg.ProblemsDir, "files")
+	os.MkdirAll(attachments, 0700)
+	os.WriteFile(path.Join(attachments, "input.txt"), []byte("1 2"), 0600)
+	os.Symlink(path.Join(outside, "secret"), path.Join(attachments, "leak"))
+	SetProblems(map[string]Problem{"p": {Id: "p", Attachments: attachments}})
+	t.Cleanup(func() { SetProblems(nil) })
+
+	fs, err := newSftpFS("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(path.Join(fs.root, "p", "src"), 0700)
+	os.Symlink("src", path.Join(fs.root, "p", "inside"))
+	os.Symlink(outside, path.Join(fs.root, "out"))
+	os.Symlink(path.Join(outside, "missing"), path.Join(fs.root, "dangling"))
+
+	tests := []struct {
+		path string
+		want string // relative to the workspace, unless absolute
+		err  error
+	}{
+		{"/", ".", nil},
+		{"p/src/main.c", "p/src/main.c", nil},
+		{"/../../etc/passwd", "etc/passwd", nil},
+		{"p/../../../etc", "etc", nil},
+		{"p/inside/main.c", "p/inside/main.c", nil},
+		{"/out/secret", "", errSftpEscape},
+		{"/out", "", errSftpEscape},
+		{"/dangling", "", errSftpEscape},
+		{"/dangling/x", "", errSftpEscape},
+		{"/problems/p/input.txt", attachments + "/input.txt", nil},
+		{"/problems/p/leak", "", os.ErrPermission},
+		{"/problems/p/../../etc/passwd", "etc/passwd", nil},
+		{"/problems/q/input.txt", "", os.ErrNotExist},
+	}
+	for _, tt := range tests {
+		got, err := fs.resolve(tt.path)
+		if tt.err != nil {
+			if !errors.Is(err, tt.err) {
+				t.Errorf("resolve(%q) = %q, %v, want %v", tt.path, got, err, tt.err)
+			}
+			continue
+		}
+		want := tt.want
+		if !path.IsAbs(want) {
+			want = path.Join(fs.root, want)
+		}
+		if err != nil || got != want {
+			t.Errorf("resolve(%q) = %q, %v, want %s", tt.path, got, err, want)
+		}
+	}
+}
+
+func TestSftpQuota(t *testing.T) {
+	setupTestEnv(t)
+	cfg.QuotaBytes = 100
+	cfg.QuotaInodes = 3 // the files and directories in the workspace
+
+	client := sftpClient(t, "alice")
+
+	if err := client.Mkdir("/p"); err != nil {
+		t.Fatal(err)
+	}
+	write := func(name string, n int) error {
+		f, err := client.Create(name)
+		if err != nil {
+			return err
+		}
+		_, err = f.Write([]byte(strings.Repeat("x", n)))
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		return err
+	}
+
+	if err := write("/p/a", 80); err != nil {
+		t.Fatalf("write within quota: %v", err)
+	}
+	if err := write("/p/b", 50); err == nil {
+		t.Fatal("write over the byte quota succeeded")
+	}
+	if err := write("/p/c", 10); err == nil {
+		t.Fatal("file over the inode quota created")
+	}
+	if err := client.Remove("/p/a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := write("/p/d", 90); err != nil {
+		t.Fatalf("write after freeing space: %v", err)
+	}
+
+	usage := WorkspaceUsage("alice")
+	if usage.Bytes > cfg.QuotaBytes || usage.Inodes > cfg.QuotaInodes {
+		t.Errorf("workspace at %+v, over the quota", usage)
+	}
+}
+
+func TestSftpProblemsReadOnly(t *testing.T) {
+	setupTestEnv(t)
+
+	attachments := path.Join(cfg.ProblemsDir, "files")
+	os.MkdirAll(attachments, 0700)
+	os.WriteFile(path.Join(attachments, "input.txt"), []byte("1 2"), 0600)
+	SetProblems(map[string]Problem{"p": {Id: "p", Attachments: attachments}})
+	t.Cleanup(func() { SetProblems(nil) })
+
+	client := sftpClient(t, "alice")
+
+	f, err := client.Open("/problems/p/input.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(f)
+	f.Close()
+	if string(b) != "1 2" {
+		t.Errorf("read %q from the attachment", b)
+	}
+
+	if _, err := client.Create("/problems/p/input.txt"); err == nil {
+		t.Error("attachment opened for writing")
+	}
+	if err := client.Remove("/problems/p/input.txt"); err == nil {
+		t.Error("attachment removed")
+	}
+	if err := client.Mkdir("/problems/p/x"); err == nil {
+		t.Error("directory made below /problems")
+	}
+	if _, err := os.Stat(path.Join(attachments, "input.txt")); err != nil {
+		t.Error(err)
+	}
+}
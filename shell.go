@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	shlex "github.com/anmitsu/go-shlex"
+	ssh "github.com/gliderlabs/ssh"
+	"github.com/logrusorgru/aurora/v4"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/term"
+)
+
+var shellCommands = []string{"problems", "problem", "submit", "list", "status", "rank", "my", "quota", "snap", "top", "help", "exit"}
+
+var admCommands = []string{"list", "status", "pause", "reload", "images", "quota", "gc"}
+
+// RunShell serves a session with a PTY and no command: a prompt with
+// history and tab completion, running the commands of exec mode until exit
+// or Ctrl-D.
+func RunShell(s ssh.Session, tctx context.Context) {
+	in := newShellInput(s)
+	defer in.close()
+
+	sh := &shell{s: s, in: in}
+	sh.t = term.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{in, s}, aurora.Bold(aurora.BrightBlue(s.User())).String()+"@soj> ")
+	sh.t.AutoCompleteCallback = sh.complete
+
+	_, winCh, _ := s.Pty()
+	go func() {
+		for win := range winCh {
+			sh.t.SetSize(win.Width, win.Height)
+		}
+	}()
+
+	// the terminal redraws the prompt below what is written while reading
+	if IsAdmin(s.User()) {
+		reloads := make(chan ReloadResult, 1)
+		defer WatchReloads(reloads)()
+		go func() {
+			for {
+				select {
+				case res := <-reloads:
+					ShowReload(Userface{Buffer: bytes.NewBuffer(nil), Writer: sh.t}, res)
+				case <-in.done:
+					return
+				}
+			}
+		}()
+	}
+
+	uf := Userface{Buffer: bytes.NewBuffer(nil), Writer: sh.t}
+	PrintWelcome(uf, s.User())
+	uf.Println("Type", aurora.Bold("help"), "for the commands,", aurora.Bold("Tab"), "to complete")
+	uf.Println()
+
+	for {
+		line, err := sh.t.ReadLine()
+		if err == io.EOF {
+			fmt.Fprint(s, "\r\n")
+			return
+		}
+		if err != nil && err != term.ErrPasteIndicator {
+			return
+		}
+
+		cmds, err := shlex.Split(line, true)
+		if err != nil {
+			uf.Println(aurora.Red("error:"), err)
+			continue
+		}
+		format, cmds := ParseOutputFlags(cmds)
+		if len(cmds) == 0 {
+			continue
+		}
+		log.Info().Str("user", s.User()).Strs("cmds", cmds).Msg("shell command")
+
+		uf := Userface{Buffer: bytes.NewBuffer(nil), Writer: sh.t}
+		switch cmds[0] {
+		case "exit", "quit", "logout":
+			return
+		case "help":
+			PrintHelp(uf)
+			uf.Println("Use 'top' to watch your submissions being judged")
+			uf.Println("Use 'exit' or Ctrl-D to leave")
+			uf.Println()
+		case "top":
+			sh.top()
+		case "submit", "sub":
+			if len(cmds) == 3 && cmds[2] == "--stdin" {
+				uf.Println(aurora.Red("error:"), "--stdin is not available in the shell")
+				continue
+			}
+			fallthrough
+		default:
+			RunCommand(s, tctx, uf, &Output{Format: format, W: sh.t}, cmds)
+		}
+	}
+}
+
+type shell struct {
+	s  ssh.Session
+	t  *term.Terminal
+	in *shellInput
+}
+
+// shellInput reads the session in the background, so that top can wait for
+// a key and its ticker at once. The terminal ends ReadLine on Ctrl-C, which
+// is turned into clearing the line instead.
+type shellInput struct {
+	keys    chan []byte
+	done    chan struct{}
+	pending []byte
+}
+
+func newShellInput(r io.Reader) *shellInput {
+	in := &shellInput{keys: make(chan []byte), done: make(chan struct{})}
+	go func() {
+		defer close(in.keys)
+		for {
+			buf := make([]byte, 256)
+			n, err := r.Read(buf)
+			if n > 0 {
+				select {
+				case in.keys <- buf[:n]:
+				case <-in.done:
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return in
+}
+
+func (in *shellInput) close() {
+	close(in.done)
+}
+
+func (in *shellInput) Read(p []byte) (int, error) {
+	if len(in.pending) == 0 {
+		b, ok := <-in.keys
+		if !ok {
+			return 0, io.EOF
+		}
+		// ^E^U: to the end of the line and erase it
+		in.pending = bytes.ReplaceAll(b, []byte{3}, []byte{5, 21})
+	}
+	n := copy(p, in.pending)
+	in.pending = in.pending[n:]
+	return n, nil
+}
+
+// complete completes the word before the cursor on Tab. If it is ambiguous,
+// the candidates are listed.
+func (sh *shell) complete(line string, pos int, key rune) (string, int, bool) {
+	if key != '\t' {
+		return "", 0, false
+	}
+
+	head := line[:pos]
+	args := strings.Fields(head)
+	var word string
+	if len(args) > 0 && !strings.HasSuffix(head, " ") {
+		word = args[len(args)-1]
+		args = args[:len(args)-1]
+	}
+
+	var matches []string
+	for _, c := range sh.candidates(args) {
+		if strings.HasPrefix(c, word) {
+			matches = append(matches, c)
+		}
+	}
+	if len(matches) == 0 {
+		return "", 0, false
+	}
+
+	common := matches[0]
+	for _, m := range matches[1:] {
+		for !strings.HasPrefix(m, common) {
+			common = common[:len(common)-1]
+		}
+	}
+	if len(matches) == 1 {
+		common += " "
+	}
+	if common == word {
+		fmt.Fprintln(sh.t, strings.Join(matches, "  "))
+		return line, pos, true
+	}
+
+	insert := common[len(word):]
+	return head + insert + line[pos:], pos + len(insert), true
+}
+
+// candidates returns what may follow args.
+func (sh *shell) candidates(args []string) []string {
+	user := sh.s.User()
+	if len(args) == 0 {
+		if IsAdmin(user) {
+			return append(shellCommands, "adm")
+		}
+		return shellCommands
+	}
+
+	switch args[0] {
+	case "problem", "submit", "sub":
+		if len(args) == 1 {
+			return SortedProblemIds(CurrentProblems())
+		}
+	case "status", "st":
+		if len(args) == 1 {
+			return recentSubmitIds(user)
+		}
+	case "snap":
+		switch {
+		case len(args) == 1:
+			return SortedProblemIds(CurrentProblems())
+		case len(args) == 2:
+			return []string{"take", "diff", "restore"}
+		case len(args) == 3 && (args[2] == "diff" || args[2] == "restore"):
+			snaps, _ := ListSnapshots(user, args[1])
+			var ids []string
+			for _, snap := range snaps {
+				ids = append(ids, snap.ID)
+			}
+			return ids
+		}
+	case "adm":
+		if !IsAdmin(user) {
+			return nil
+		}
+		switch {
+		case len(args) == 1:
+			return admCommands
+		case len(args) == 2 && args[1] == "status":
+			return recentSubmitIds("")
+		}
+	}
+	return nil
+}
+
+// recentSubmitIds returns the ids of the last submissions of user, or of
+// everyone if user is empty.
+func recentSubmitIds(user string) []string {
+	var ids []string
+	db.Model(&SubmitCtx{}).Where(&SubmitCtx{User: user}).Order("submit_time desc").Limit(20).Pluck("id", &ids)
+	sort.Strings(ids)
+	return ids
+}
+
+// top shows the user's submissions being judged, refreshed every second
+// until q or Ctrl-C.
+func (sh *shell) top() {
+	fmt.Fprint(sh.s, "\x1b[?1049h\x1b[?25l")
+	defer fmt.Fprint(sh.s, "\x1b[?25h\x1b[?1049l")
+
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+
+	for {
+		var submits []SubmitCtx
+		db.Select(submitListColumns).Where(ofUser(sh.s.User())).Where("status != ? AND status != ? AND status != ?", "completed", "dead", "failed").Order("submit_time desc").Find(&submits)
+
+		var ids, problems, statuses, msgs, elapsed []string
+		for _, submit := range submits {
+			ids = append(ids, submit.ID)
+			problems = append(problems, submit.Problem)
+			statuses = append(statuses, submit.Status)
+			msgs = append(msgs, OmitStr(submit.Msg, 40))
+			elapsed = append(elapsed, time.Since(time.Unix(0, submit.SubmitTime)).Truncate(time.Second).String())
+		}
+
+		uf := Userface{Buffer: bytes.NewBuffer(nil), Writer: sh.t}
+		fmt.Fprint(sh.s, "\x1b[H\x1b[2J")
+		uf.Println(aurora.Bold("SOJ top"), "-", aurora.Yellow(time.Now().Format(time.DateTime+" MST")), "-", aurora.Bold(len(submits)), "running", aurora.Gray(15, "(q to quit)"))
+		uf.Println()
+		MkTable(uf, []string{"ID", "Problem", "Status", "Message", "Elapsed"}, []aurora.Color{aurora.MagentaFg, aurora.BoldFm | aurora.ItalicFm, aurora.YellowFg, aurora.BlueFg, aurora.WhiteFg}, [][]string{ids, problems, statuses, msgs, elapsed})
+
+		select {
+		case b, ok := <-sh.in.keys:
+			if !ok || bytes.ContainsAny(b, "qQ\x03") {
+				return
+			}
+		case <-tick.C:
+		case <-sh.s.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,498 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/logrusorgru/aurora/v4"
+	"github.com/pmezard/go-difflib/difflib"
+	"github.com/rs/zerolog/log"
+)
+
+// Snapshot is a copy of a problem workspace, SubmitsDir/<user>/<problem>,
+// kept in SnapshotsDir/<user>/<problem>/<id>. Unchanged files are hard
+// links to the previous snapshot.
+type Snapshot struct {
+	ID      string
+	User    string
+	Problem string
+	Time    int64
+	Reason  string // submit, periodic, manual, push or restore
+	Submit  string `json:",omitempty"` // the submission that took it
+	Files   []SnapshotFile
+}
+
+type SnapshotFile struct {
+	Path    string
+	Size    int64
+	Mode    fs.FileMode
+	ModTime int64
+	Sum     string // sha256
+}
+
+// snapshotDiffMax is the size up to which modified files are diffed line by line.
+const snapshotDiffMax = 1 << 20
+
+// one snapshot at a time, so the periodic ones do not race with submits
+var snapshotMu sync.Mutex
+
+// SnapshotsDir is where workspace snapshots are kept, outside of SubmitsDir
+// so that they do not count against quotas.
+func (c Config) SnapshotsDir() string {
+	if c.SnapshotDir != "" {
+		return c.SnapshotDir
+	}
+	return path.Join(path.Dir(path.Clean(c.SubmitsDir)), "snapshots")
+}
+
+func snapshotRoot(user, problem string) string {
+	return path.Join(cfg.SnapshotsDir(), user, problem)
+}
+
+// RunSnapshotLoop snapshots all workspaces every SnapshotInterval minutes.
+func RunSnapshotLoop() {
+	interval := cfg.SnapshotInterval
+	if interval < 0 {
+		return
+	}
+	if interval == 0 {
+		interval = 60
+	}
+
+	for {
+		time.Sleep(time.Duration(interval) * time.Minute)
+
+		users, err := os.ReadDir(cfg.SubmitsDir)
+		if err != nil {
+			log.Err(err).Str("dir", cfg.SubmitsDir).Msg("snapshot: failed to read submits dir")
+			continue
+		}
+		var taken int
+		for _, u := range users {
+			if !u.IsDir() {
+				continue
+			}
+			problems, _ := os.ReadDir(path.Join(cfg.SubmitsDir, u.Name()))
+			for _, p := range problems {
+				if !p.IsDir() {
+					continue
+				}
+				snap, err := TakeSnapshot(u.Name(), p.Name(), "periodic", "")
+				if err != nil {
+					log.Err(err).Str("user", u.Name()).Str("problem", p.Name()).Msg("snapshot: failed to take snapshot")
+					continue
+				}
+				if snap != nil {
+					taken++
+				}
+			}
+		}
+		if taken > 0 {
+			log.Info().Int("snapshots", taken).Msg("periodic snapshots taken")
+		}
+	}
+}
+
+// TakeSnapshot copies the workspace of user for problem. It returns nil
+// without an error if the workspace is missing, empty or unchanged since
+// the last snapshot.
+func TakeSnapshot(user, problem, reason, submit string) (*Snapshot, error) {
+	snapshotMu.Lock()
+	defer snapshotMu.Unlock()
+
+	src := path.Join(cfg.SubmitsDir, user, problem)
+	root := snapshotRoot(user, problem)
+
+	var last *Snapshot
+	if snaps, err := ListSnapshots(user, problem); err == nil && len(snaps) > 0 {
+		last = &snaps[0]
+	}
+	prev := map[string]SnapshotFile{}
+	if last != nil {
+		for _, f := range last.Files {
+			prev[f.Path] = f
+		}
+	}
+
+	var files []SnapshotFile
+	err := filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == src && os.IsNotExist(err) {
+				return fs.SkipAll
+			}
+			return err
+		}
+		// symlinks are not followed, they could lead anywhere
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(src, p)
+		f := SnapshotFile{Path: rel, Size: info.Size(), Mode: info.Mode().Perm(), ModTime: info.ModTime().UnixNano()}
+		if pf, ok := prev[rel]; ok && pf.Size == f.Size && pf.ModTime == f.ModTime {
+			f.Sum = pf.Sum
+		} else if f.Sum, err = fileSum(p); err != nil {
+			return err
+		}
+		files = append(files, f)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 || (last != nil && sameFiles(last.Files, files)) {
+		return nil, nil
+	}
+
+	now := time.Now()
+	snap := Snapshot{
+		ID:      now.Format("20060102-150405"),
+		User:    user,
+		Problem: problem,
+		Time:    now.UnixNano(),
+		Reason:  reason,
+		Submit:  submit,
+		Files:   files,
+	}
+	for i := 2; ; i++ {
+		if _, err := os.Lstat(path.Join(root, snap.ID)); os.IsNotExist(err) {
+			break
+		}
+		snap.ID = now.Format("20060102-150405") + "-" + strconv.Itoa(i)
+	}
+
+	tmp := path.Join(root, ".tmp-"+snap.ID)
+	os.RemoveAll(tmp)
+	if err := os.MkdirAll(tmp, 0700); err != nil {
+		return nil, err
+	}
+
+	for _, f := range files {
+		dst := path.Join(tmp, "files", f.Path)
+		os.MkdirAll(path.Dir(dst), 0700)
+
+		if pf, ok := prev[f.Path]; ok && pf.Sum == f.Sum {
+			if os.Link(path.Join(root, last.ID, "files", f.Path), dst) == nil {
+				continue
+			}
+		}
+		if _, err := CopyFile(path.Join(src, f.Path), dst); err != nil {
+			os.RemoveAll(tmp)
+			return nil, err
+		}
+		os.Chmod(dst, 0400)
+	}
+
+	meta, _ := json.Marshal(snap)
+	if err := os.WriteFile(path.Join(tmp, "snapshot.json"), meta, 0600); err != nil {
+		os.RemoveAll(tmp)
+		return nil, err
+	}
+	if err := os.Rename(tmp, path.Join(root, snap.ID)); err != nil {
+		os.RemoveAll(tmp)
+		return nil, err
+	}
+
+	metricSnapshots.WithLabelValues(reason).Inc()
+	log.Debug().Str("user", user).Str("problem", problem).Str("snapshot", snap.ID).Str("reason", reason).Int("files", len(files)).Msg("took snapshot")
+
+	pruneSnapshots(user, problem)
+	return &snap, nil
+}
+
+func fileSum(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func sameFiles(a, b []SnapshotFile) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Path != b[i].Path || a[i].Sum != b[i].Sum || a[i].Mode != b[i].Mode {
+			return false
+		}
+	}
+	return true
+}
+
+// ListSnapshots returns the snapshots of a workspace, newest first.
+func ListSnapshots(user, problem string) ([]Snapshot, error) {
+	root := snapshotRoot(user, problem)
+	entries, err := os.ReadDir(root)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var snaps []Snapshot
+	for _, e := range entries {
+		if !e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		meta, err := os.ReadFile(path.Join(root, e.Name(), "snapshot.json"))
+		if err != nil {
+			continue
+		}
+		var snap Snapshot
+		if json.Unmarshal(meta, &snap) != nil {
+			continue
+		}
+		snaps = append(snaps, snap)
+	}
+	sort.Slice(snaps, func(i, j int) bool { return snaps[i].Time > snaps[j].Time })
+	return snaps, nil
+}
+
+// FindSnapshot looks up a snapshot by a part of its ID or of the
+// submission that took it, preferring the newest.
+func FindSnapshot(user, problem, id string) (*Snapshot, error) {
+	snaps, err := ListSnapshots(user, problem)
+	if err != nil {
+		return nil, err
+	}
+	for i := range snaps {
+		if snaps[i].ID == id || snaps[i].Submit == id {
+			return &snaps[i], nil
+		}
+	}
+	for i := range snaps {
+		if strings.Contains(snaps[i].ID, id) || (snaps[i].Submit != "" && strings.Contains(snaps[i].Submit, id)) {
+			return &snaps[i], nil
+		}
+	}
+	return nil, os.ErrNotExist
+}
+
+// pruneSnapshots keeps the newest SnapshotKeep snapshots of a workspace.
+func pruneSnapshots(user, problem string) {
+	keep := cfg.SnapshotKeep
+	if keep == 0 {
+		keep = 20
+	}
+	if keep < 0 {
+		return
+	}
+
+	snaps, err := ListSnapshots(user, problem)
+	if err != nil || len(snaps) <= keep {
+		return
+	}
+	for _, snap := range snaps[keep:] {
+		dir := path.Join(snapshotRoot(user, problem), snap.ID)
+		if err := os.RemoveAll(dir); err != nil {
+			log.Err(err).Str("dir", dir).Msg("snapshot: failed to remove snapshot")
+		}
+	}
+}
+
+// RestoreSnapshot replaces the workspace with the files of snap. The
+// workspace is snapshotted first, so a restore can be undone.
+func RestoreSnapshot(snap *Snapshot) (*Snapshot, error) {
+	before, err := TakeSnapshot(snap.User, snap.Problem, "restore", "")
+	if err != nil {
+		return nil, err
+	}
+
+	dst := path.Join(cfg.SubmitsDir, snap.User, snap.Problem)
+	src := path.Join(snapshotRoot(snap.User, snap.Problem), snap.ID, "files")
+
+	var names []string
+	var size int64
+	for _, f := range snap.Files {
+		names = append(names, f.Path)
+		size += f.Size
+	}
+	if !fitsQuota(snap.User, dst, []string{"."}, names, size) {
+		return before, errQuota
+	}
+
+	snapshotMu.Lock()
+	defer snapshotMu.Unlock()
+	defer rescanQuota(snap.User)
+
+	if err := os.RemoveAll(dst); err != nil {
+		return before, err
+	}
+	if err := mkdirOwned(dst); err != nil {
+		return before, err
+	}
+
+	for _, f := range snap.Files {
+		p := path.Join(dst, f.Path)
+		mkdirOwned(path.Dir(p))
+		if _, err := CopyFile(path.Join(src, f.Path), p); err != nil {
+			return before, err
+		}
+		os.Chown(p, cfg.SubmitUid, cfg.SubmitGid)
+		os.Chmod(p, f.Mode)
+		mtime := time.Unix(0, f.ModTime)
+		os.Chtimes(p, mtime, mtime)
+	}
+
+	log.Info().Str("user", snap.User).Str("problem", snap.Problem).Str("snapshot", snap.ID).Msg("restored snapshot")
+	return before, nil
+}
+
+// mkdirOwned creates dir and its missing parents, owned by SubmitUid.
+func mkdirOwned(dir string) error {
+	if _, err := os.Stat(dir); err == nil {
+		return nil
+	}
+	if err := mkdirOwned(path.Dir(dir)); err != nil {
+		return err
+	}
+	if err := os.Mkdir(dir, 0700); err != nil && !os.IsExist(err) {
+		return err
+	}
+	os.Chown(dir, cfg.SubmitUid, cfg.SubmitGid)
+	return nil
+}
+
+// readWorkspaceFile reads p, a regular file in the workspace dir. Like
+// TakeSnapshot it ignores anything else: links, also as parent directories,
+// are made by users and may point to any file of the host.
+func readWorkspaceFile(dir, p string) ([]byte, error) {
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return nil, err
+	}
+	full := filepath.Join(root, p)
+	if parent, err := filepath.EvalSymlinks(path.Dir(full)); err != nil || parent != path.Dir(full) {
+		return nil, os.ErrNotExist
+	}
+	if info, err := os.Lstat(full); err != nil || !info.Mode().IsRegular() {
+		return nil, os.ErrNotExist
+	}
+
+	// the path may have been swapped for a link since
+	f, err := os.OpenFile(full, os.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err != nil || !info.Mode().IsRegular() {
+		return nil, os.ErrNotExist
+	}
+	return io.ReadAll(f)
+}
+
+// DiffSnapshot prints how the workspace changed since snap was taken.
+// With file set, only that file is compared.
+func DiffSnapshot(uf Userface, snap *Snapshot, file string) error {
+	dir := path.Join(cfg.SubmitsDir, snap.User, snap.Problem)
+	src := path.Join(snapshotRoot(snap.User, snap.Problem), snap.ID, "files")
+
+	old := map[string]SnapshotFile{}
+	var paths []string
+	for _, f := range snap.Files {
+		old[f.Path] = f
+		paths = append(paths, f.Path)
+	}
+	filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return nil
+		}
+		rel, _ := filepath.Rel(dir, p)
+		if _, ok := old[rel]; !ok {
+			paths = append(paths, rel)
+		}
+		return nil
+	})
+	sort.Strings(paths)
+
+	var changed int
+	for _, p := range paths {
+		if file != "" && p != path.Clean(file) {
+			continue
+		}
+
+		f, inSnap := old[p]
+		cur, err := readWorkspaceFile(dir, p)
+		inDir := err == nil
+
+		switch {
+		case !inDir:
+			changed++
+			uf.Println(aurora.Red("deleted:"), aurora.Bold(p))
+			continue
+		case !inSnap:
+			changed++
+			uf.Println(aurora.Green("new:"), aurora.Bold(p))
+			continue
+		}
+
+		sum := sha256.Sum256(cur)
+		if hex.EncodeToString(sum[:]) == f.Sum {
+			continue
+		}
+		changed++
+		uf.Println(aurora.Yellow("modified:"), aurora.Bold(p))
+
+		prev, err := os.ReadFile(path.Join(src, p))
+		if err != nil {
+			return err
+		}
+		if len(prev) > snapshotDiffMax || len(cur) > snapshotDiffMax || bytes.IndexByte(prev, 0) >= 0 || bytes.IndexByte(cur, 0) >= 0 {
+			uf.Println("	", aurora.Gray(15, "binary or large file, not shown"))
+			continue
+		}
+		diff, _ := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+			A:        difflib.SplitLines(string(prev)),
+			B:        difflib.SplitLines(string(cur)),
+			FromFile: "a/" + p + " (" + snap.ID + ")",
+			ToFile:   "b/" + p,
+			Context:  3,
+		})
+		for _, line := range strings.SplitAfter(diff, "\n") {
+			switch {
+			case strings.HasPrefix(line, "+++"), strings.HasPrefix(line, "---"):
+				uf.Write([]byte(aurora.Bold(line).String()))
+			case strings.HasPrefix(line, "+"):
+				uf.Write([]byte(aurora.Green(line).String()))
+			case strings.HasPrefix(line, "-"):
+				uf.Write([]byte(aurora.Red(line).String()))
+			case strings.HasPrefix(line, "@@"):
+				uf.Write([]byte(aurora.Cyan(line).String()))
+			default:
+				uf.Write([]byte(line))
+			}
+		}
+		if !strings.HasSuffix(diff, "\n") {
+			uf.Println()
+		}
+	}
+
+	if changed == 0 {
+		uf.Println(aurora.Gray(15, "No changes"))
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestDiffSnapshotIgnoresLinks(t *testing.T) {
+	setupTestEnv(t)
+
+	outside := t.TempDir()
+	os.WriteFile(path.Join(outside, "secret"), []byte("root only\n"), 0600)
+
+	ws := path.Join(cfg.SubmitsDir, "alice", "p")
+	os.MkdirAll(path.Join(ws, "src"), 0700)
+	os.WriteFile(path.Join(ws, "main.c"), []byte("int main(){}\n"), 0600)
+	os.WriteFile(path.Join(ws, "src", "secret"), []byte("mine\n"), 0600)
+
+	snap, err := TakeSnapshot("alice", "p", "manual", "")
+	if err != nil || snap == nil {
+		t.Fatalf("no snapshot: %v", err)
+	}
+
+	// the snapshotted files become links to a file of the host
+	os.Remove(path.Join(ws, "main.c"))
+	os.Symlink(path.Join(outside, "secret"), path.Join(ws, "main.c"))
+	os.RemoveAll(path.Join(ws, "src"))
+	os.Symlink(outside, path.Join(ws, "src"))
+
+	for _, file := range []string{"", "main.c", "src/secret"} {
+		var buf bytes.Buffer
+		if err := DiffSnapshot(Userface{Buffer: &bytes.Buffer{}, Writer: &buf}, snap, file); err != nil {
+			t.Fatal(err)
+		}
+		out := buf.String()
+		if strings.Contains(out, "root only") {
+			t.Errorf("diff of %q shows a host file:\n%s", file, out)
+		}
+		for _, p := range []string{"main.c", "src/secret"} {
+			if (file == "" || file == p) && !strings.Contains(out, p) {
+				t.Errorf("diff of %q does not list %s as deleted:\n%s", file, p, out)
+			}
+		}
+	}
+}
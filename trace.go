@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/rs/zerolog/log"
+)
+
+var tracer = otel.Tracer("github.com/mrhaoxx/SOJ")
+
+// InitTracing installs the global tracer provider according to cfg.
+// Spans go to the OTLP/HTTP endpoint if TraceEndpoint is set, otherwise
+// to TraceFile as JSON lines. With neither configured tracing stays a no-op.
+// The returned function flushes pending spans and must be called on exit.
+func InitTracing() func() {
+	var exporter sdktrace.SpanExporter
+	var file *os.File
+	var err error
+
+	switch {
+	case cfg.TraceEndpoint != "":
+		opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(cfg.TraceEndpoint)}
+		if cfg.TraceInsecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(context.Background(), opts...)
+		if err != nil {
+			log.Fatal().Err(err).Str("endpoint", cfg.TraceEndpoint).Msg("failed to create otlp trace exporter")
+		}
+		log.Info().Str("endpoint", cfg.TraceEndpoint).Msg("tracing to otlp endpoint")
+
+	case cfg.TraceFile != "":
+		file, err = os.OpenFile(cfg.TraceFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			log.Fatal().Err(err).Str("file", cfg.TraceFile).Msg("failed to open trace file")
+		}
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(file))
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to create file trace exporter")
+		}
+		log.Info().Str("file", cfg.TraceFile).Msg("tracing to file")
+
+	default:
+		return func() {}
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName("soj"))),
+	)
+	otel.SetTracerProvider(tp)
+
+	return func() {
+		err := tp.Shutdown(context.Background())
+		if err != nil {
+			log.Err(err).Msg("failed to shutdown tracer provider")
+		}
+		// the exporter does not own the file
+		if file != nil {
+			file.Close()
+		}
+	}
+}
+
+// EndSpan records err on span, if any, and ends it.
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func submitAttrs(ctx *SubmitCtx) trace.SpanStartEventOption {
+	return trace.WithAttributes(
+		attribute.String("soj.submit.id", ctx.ID),
+		attribute.String("soj.submit.user", ctx.User),
+		attribute.String("soj.submit.problem", ctx.Problem),
+	)
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/distribution/reference"
+)
+
+// ProblemError is a mistake in a problem file.
+type ProblemError struct {
+	File    string // relative to the problems directory
+	Problem string // id, if the file could be read
+	Field   string // where in the problem, e.g. "workflow 1 show"
+	Msg     string
+}
+
+func (e ProblemError) Error() string {
+	var parts []string
+	for _, p := range []string{e.File, e.Problem, e.Field} {
+		if p != "" {
+			parts = append(parts, p)
+		}
+	}
+	return strings.Join(append(parts, e.Msg), ": ")
+}
+
+// ProblemErrors are the mistakes of a problem set.
+type ProblemErrors []ProblemError
+
+func (errs ProblemErrors) Error() string {
+	var lines []string
+	for _, e := range errs {
+		lines = append(lines, e.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+var problemId = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// reserved mount targets, see JobMounts
+var reservedTargets = []string{"/submits", "/work", attachmentsTarget}
+
+// ValidateProblem checks a problem loaded from file in dir for what would
+// only fail once somebody submits.
+func ValidateProblem(file string, pb Problem, dir string) []ProblemError {
+	var errs []ProblemError
+	fail := func(field, format string, a ...interface{}) {
+		errs = append(errs, ProblemError{File: file, Problem: pb.Id, Field: field, Msg: fmt.Sprintf(format, a...)})
+	}
+
+	switch {
+	case pb.Id == "":
+		fail("id", "missing")
+	case !problemId.MatchString(pb.Id):
+		fail("id", "%s may only have letters, digits, '.', '_' and '-'", strconv.Quote(pb.Id))
+	}
+	if pb.Weight < 0 {
+		fail("weight", "must not be negative")
+	}
+
+	if len(pb.Submits) == 0 {
+		fail("submits", "no files to submit")
+	}
+	for i, submit := range pb.Submits {
+		p := path.Clean(submit.Path)
+		if submit.Path == "" || path.IsAbs(p) || p == "." || p == ".." || strings.HasPrefix(p, "../") {
+			fail("submits "+strconv.Itoa(i+1), "invalid path %s", strconv.Quote(submit.Path))
+		}
+	}
+
+	if pb.Attachments != "" {
+		fi, err := os.Stat(pb.Attachments)
+		switch {
+		case err != nil:
+			fail("attachments", "%v", err)
+		case !fi.IsDir():
+			fail("attachments", "%s is not a directory", pb.Attachments)
+		case !mountAllowed(pb.Attachments, dir):
+			fail("attachments", "%s is outside the problems directory and MountAllowlist", pb.Attachments)
+		}
+	}
+
+	if len(pb.Workflow) == 0 {
+		fail("workflow", "no workflows")
+	}
+	for i, wf := range pb.Workflow {
+		field := "workflow " + strconv.Itoa(i+1)
+
+		if err := validateImage(wf.Image); err != nil {
+			fail(field+" image", "%v", err)
+		}
+		if len(wf.Steps) == 0 {
+			fail(field+" steps", "no steps")
+		}
+		if wf.Timeout <= 0 {
+			fail(field+" timeout", "must be a positive number of seconds")
+		}
+		for _, step := range wf.Show {
+			if step < 1 || step > len(wf.Steps) {
+				fail(field+" show", "no step %d, steps count from 1 to %d", step, len(wf.Steps))
+			}
+		}
+		for _, step := range wf.PrivilegedSteps {
+			if step < 1 || step > len(wf.Steps) {
+				fail(field+" privilegedsteps", "no step %d, steps count from 1 to %d", step, len(wf.Steps))
+			}
+		}
+
+		switch wf.Network {
+		case "", "isolated", "bridge":
+		default:
+			fail(field+" network", "unknown network %s", strconv.Quote(wf.Network))
+		}
+		if (wf.Network == "isolated" || len(wf.Services) > 0) && (wf.NetworkHostMode || wf.DisableNetwork) {
+			fail(field+" network", "isolated workflows can not use networkhostmode or disablenetwork")
+		}
+		if wf.Network == "bridge" && len(wf.Services) > 0 {
+			fail(field+" network", "workflows with services are isolated")
+		}
+
+		for j, mnt := range wf.Mounts {
+			if err := validateMount(mnt, dir); err != nil {
+				fail(field+" mounts "+strconv.Itoa(j+1), "%v", err)
+			}
+		}
+		if err := validateSeccomp(wf.Security, dir); err != nil {
+			fail(field+" security", "%v", err)
+		}
+
+		names := map[string]bool{}
+		for _, svc := range wf.Services {
+			sfield := field + " service " + strconv.Quote(svc.Name)
+			switch {
+			case svc.Name == "":
+				fail(field+" services", "service without a name")
+			case names[svc.Name]:
+				fail(sfield, "duplicate name")
+			case svc.Name == "judge":
+				fail(sfield, "the name judge is taken by the judge container")
+			}
+			names[svc.Name] = true
+
+			if err := validateImage(svc.Image); err != nil {
+				fail(sfield+" image", "%v", err)
+			}
+			if svc.Security != nil {
+				if err := validateSeccomp(*svc.Security, dir); err != nil {
+					fail(sfield+" security", "%v", err)
+				}
+			}
+		}
+	}
+
+	return errs
+}
+
+func validateImage(image string) error {
+	if image == "" {
+		return fmt.Errorf("missing")
+	}
+	if _, err := reference.ParseNormalizedNamed(image); err != nil {
+		return fmt.Errorf("invalid image %s: %v", strconv.Quote(image), err)
+	}
+	return nil
+}
+
+// validateMount lets bind mounts only come from dir or MountAllowlist.
+func validateMount(mnt Mount, dir string) error {
+	if !path.IsAbs(mnt.Target) {
+		return fmt.Errorf("target %s is not absolute", strconv.Quote(mnt.Target))
+	}
+	for _, t := range reservedTargets {
+		if path.Clean(mnt.Target) == t {
+			return fmt.Errorf("target %s is used by SOJ", t)
+		}
+	}
+
+	switch mnt.Type {
+	case "bind":
+		if !path.IsAbs(mnt.Source) {
+			return fmt.Errorf("source %s is not absolute", strconv.Quote(mnt.Source))
+		}
+		if !mountAllowed(mnt.Source, dir) {
+			return fmt.Errorf("source %s is outside the problems directory and MountAllowlist", mnt.Source)
+		}
+	case "volume", "tmpfs":
+	default:
+		return fmt.Errorf("unknown type %s", strconv.Quote(mnt.Type))
+	}
+	return nil
+}
+
+// mountAllowed reports whether the host path p is inside dir or one of
+// MountAllowlist, with symlinks evaluated where they exist.
+func mountAllowed(p, dir string) bool {
+	real := evalPrefix(p)
+	for _, root := range append([]string{dir}, cfg.MountAllowlist...) {
+		root, err := filepath.Abs(root)
+		if err != nil {
+			continue
+		}
+		root = evalPrefix(root)
+		if real == root || strings.HasPrefix(real, strings.TrimSuffix(root, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// evalPrefix evaluates the symlinks of the longest existing prefix of p.
+func evalPrefix(p string) string {
+	p = filepath.Clean(p)
+	if real, err := filepath.EvalSymlinks(p); err == nil {
+		return real
+	}
+	if parent := filepath.Dir(p); parent != p {
+		return filepath.Join(evalPrefix(parent), filepath.Base(p))
+	}
+	return p
+}
+
+// validateSeccomp checks that a seccomp profile can be read, see Security.Apply.
+func validateSeccomp(s Security, dir string) error {
+	if s.Seccomp == "" || s.Seccomp == "unconfined" {
+		return nil
+	}
+	p := s.Seccomp
+	if !path.IsAbs(p) {
+		p = path.Join(dir, p)
+	}
+	_, err := os.ReadFile(p)
+	return err
+}